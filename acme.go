@@ -0,0 +1,95 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ShowMax/go-fqdn"
+	"github.com/ezbastion/ezb_pki/acme"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// startACMEServer serve the ACME server at /acme over TLS on
+// conf.ACME.Listen until stop is closed.
+func startACMEServer(rca *rootCA, stop <-chan bool) {
+	if conf.ACME.Listen == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", conf.ACME.Listen)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/acme/", rca.acmeHandler())
+	srv := &http.Server{Handler: mux}
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+	log.Println("ACME listen at ", conf.ACME.Listen)
+	if err := srv.Serve(tls.NewListener(listener, rca.tlsConfig())); err != nil && err != http.ErrServerClosed {
+		log.Errorln(err)
+	}
+}
+
+// acmeURL return the public url of the ACME server, conf.ACME.URL or the
+// host name with the listen port.
+func acmeURL() string {
+	if conf.ACME.URL != "" {
+		return strings.TrimSuffix(conf.ACME.URL, "/")
+	}
+	_, port, _ := net.SplitHostPort(conf.ACME.Listen)
+	return "https://" + net.JoinHostPort(fqdn.Get(), port)
+}
+
+// acmeHandler return the ACME server mounted at /acme.
+func (rca *rootCA) acmeHandler() http.Handler {
+	srv := &acme.Server{
+		BaseURL:       acmeURL() + "/acme",
+		Store:         rca.store,
+		Issue:         rca.issueACME,
+		Chain:         rca.chain,
+		PreAuthorized: acme.MatchNames(conf.ACME.PreAuthorized),
+		ErrorLog:      func(err error) { log.Errorln("ACME: ", err) },
+	}
+	log.Println("ACME directory at ", srv.BaseURL+"/directory")
+	return http.StripPrefix("/acme", srv)
+}
+
+// issueACME sign a finalized order with the ACME profile, the names were
+// proven by the challenges. The profile requested by the CSR is ignored.
+func (rca *rootCA) issueACME(csr *x509.CertificateRequest, requester string) (*x509.Certificate, error) {
+	profile := conf.ACME.Profile
+	if profile == "" {
+		profile = defaultProfile()
+	}
+	cert, err := rca.issueCSR(csr, profile, "", requester)
+	if perr, ok := err.(*protocol.Error); ok {
+		return nil, acme.Problemf(acme.ProblemRejectedIdentifier, "%s", perr.Message)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Println("ACME issued certificate to ", strings.Join(cert.DNSNames, ", "))
+	return cert, nil
+}
@@ -0,0 +1,853 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package acme is an RFC 8555 front-end to the ezb_pki CA, so standard
+// clients such as certbot, lego or cert-manager can enroll. Accounts,
+// orders and authorizations are kept in the inventory database.
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/db"
+)
+
+// Object status, RFC 8555 section 7.1.6.
+const (
+	StatusPending     = "pending"
+	StatusReady       = "ready"
+	StatusProcessing  = "processing"
+	StatusValid       = "valid"
+	StatusInvalid     = "invalid"
+	StatusDeactivated = "deactivated"
+)
+
+// Challenge types.
+const (
+	ChallengeHTTP01 = "http-01"
+	ChallengeDNS01  = "dns-01"
+)
+
+// lifetime of pending orders and authorizations.
+const orderLifetime = 7 * 24 * time.Hour
+
+// Server answer ACME requests. It is meant to be mounted with
+// http.StripPrefix at the path of BaseURL.
+type Server struct {
+	// BaseURL is the public url the server is mounted at, the directory
+	// is BaseURL + "/directory".
+	BaseURL string
+	Store   *db.Store
+	// Issue sign the CSR of a finalized order. Errors meant for the client
+	// are *Problem.
+	Issue func(csr *x509.CertificateRequest, requester string) (*x509.Certificate, error)
+	// Chain is appended to downloaded certificates.
+	Chain [][]byte
+	// PreAuthorized report identifiers trusted without challenge, nil
+	// means none.
+	PreAuthorized func(name string) bool
+	// ErrorLog receive the internal errors hidden from clients.
+	ErrorLog func(err error)
+
+	// mu serialize the read, modify and write of stored objects.
+	mu     sync.Mutex
+	nonces nonces
+}
+
+// Identifier is an order identifier, only dns is supported.
+type Identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type account struct {
+	ID        string     `json:"id"`
+	Key       jsonWebKey `json:"key"`
+	Status    string     `json:"status"`
+	Contact   []string   `json:"contact,omitempty"`
+	Orders    []string   `json:"orders,omitempty"`
+	CreatedAt time.Time  `json:"createdat"`
+}
+
+type order struct {
+	ID             string       `json:"id"`
+	Account        string       `json:"account"`
+	Status         string       `json:"status"`
+	Expires        time.Time    `json:"expires"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Authorizations []string     `json:"authorizations"`
+	Error          *Problem     `json:"error,omitempty"`
+	Certificate    []byte       `json:"certificate,omitempty"`
+}
+
+type authorization struct {
+	ID         string      `json:"id"`
+	Account    string      `json:"account"`
+	Identifier Identifier  `json:"identifier"`
+	Status     string      `json:"status"`
+	Expires    time.Time   `json:"expires"`
+	Wildcard   bool        `json:"wildcard,omitempty"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type      string     `json:"type"`
+	Token     string     `json:"token"`
+	Status    string     `json:"status"`
+	Validated *time.Time `json:"validated,omitempty"`
+	Error     *Problem   `json:"error,omitempty"`
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b64.EncodeToString(b)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "directory":
+		s.directory(w, r)
+	case len(parts) == 1 && parts[0] == "new-nonce":
+		s.newNonce(w, r)
+	case r.Method != http.MethodPost:
+		s.problem(w, Problemf(ProblemMalformed, "method %s not allowed", r.Method))
+	case len(parts) == 1 && parts[0] == "new-account":
+		s.newAccount(w, r)
+	case len(parts) == 2 && parts[0] == "account":
+		s.updateAccount(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "account" && parts[2] == "orders":
+		s.accountOrders(w, r, parts[1])
+	case len(parts) == 1 && parts[0] == "new-order":
+		s.newOrder(w, r)
+	case len(parts) == 2 && parts[0] == "order":
+		s.getOrder(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "order" && parts[2] == "finalize":
+		s.finalize(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "authz":
+		s.getAuthorization(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "chall":
+		s.postChallenge(w, r, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == "cert":
+		s.getCertificate(w, r, parts[1])
+	default:
+		s.problem(w, &Problem{Type: errorNS + "malformed", Detail: "not found", Status: http.StatusNotFound})
+	}
+}
+
+func (s *Server) url(format string, args ...interface{}) string {
+	return s.BaseURL + fmt.Sprintf(format, args...)
+}
+
+func (s *Server) directory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"newNonce":   s.url("/new-nonce"),
+		"newAccount": s.url("/new-account"),
+		"newOrder":   s.url("/new-order"),
+		"meta": map[string]interface{}{
+			"externalAccountRequired": false,
+		},
+	})
+}
+
+func (s *Server) newNonce(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.nonces.next())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.url("/directory")))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// write send v with a fresh nonce.
+func (s *Server) write(w http.ResponseWriter, status int, location string, v interface{}) {
+	w.Header().Set("Replay-Nonce", s.nonces.next())
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.url("/directory")))
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) problem(w http.ResponseWriter, p *Problem) {
+	w.Header().Set("Replay-Nonce", s.nonces.next())
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.url("/directory")))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// request is a verified JWS request.
+type request struct {
+	payload []byte
+	key     *jsonWebKey
+	account *account
+}
+
+// parse verify the JWS of r. New account requests carry their key, the
+// others refer to their account.
+func (s *Server) parse(r *http.Request, newAccount bool) (*request, *Problem) {
+	if ct := r.Header.Get("Content-Type"); ct != "application/jose+json" {
+		p := Problemf(ProblemMalformed, "expected application/jose+json")
+		p.Status = http.StatusUnsupportedMediaType
+		return nil, p
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		return nil, Problemf(ProblemMalformed, "%v", err)
+	}
+	msg, header, err := decodeJWS(body)
+	if err != nil {
+		return nil, Problemf(ProblemMalformed, "invalid JWS: %v", err)
+	}
+	if !s.nonces.use(header.Nonce) {
+		return nil, Problemf(ProblemBadNonce, "invalid or reused nonce")
+	}
+	if header.URL != s.BaseURL+r.URL.Path {
+		return nil, Problemf(ProblemUnauthorized, "url header %q does not match the request", header.URL)
+	}
+
+	req := &request{}
+	switch {
+	case newAccount:
+		if header.JWK == nil || header.KID != "" {
+			return nil, Problemf(ProblemMalformed, "new account requests must carry a jwk and no kid")
+		}
+		req.key = header.JWK
+	default:
+		if header.JWK != nil || header.KID == "" {
+			return nil, Problemf(ProblemMalformed, "requests must carry a kid and no jwk")
+		}
+		id := strings.TrimPrefix(header.KID, s.url("/account/"))
+		if id == header.KID {
+			return nil, Problemf(ProblemAccountDoesNotExist, "unknown account %s", header.KID)
+		}
+		var acct account
+		if err := s.Store.ACME("account", id, &acct); err == db.ErrNotFound {
+			return nil, Problemf(ProblemAccountDoesNotExist, "unknown account %s", header.KID)
+		} else if err != nil {
+			return nil, s.internal(err)
+		}
+		if acct.Status != StatusValid {
+			return nil, Problemf(ProblemUnauthorized, "account is %s", acct.Status)
+		}
+		req.account = &acct
+		req.key = &acct.Key
+	}
+
+	pub, err := req.key.publicKey()
+	if err != nil {
+		return nil, Problemf(ProblemBadPublicKey, "%v", err)
+	}
+	sig, err := b64.DecodeString(msg.Signature)
+	if err != nil {
+		return nil, Problemf(ProblemMalformed, "invalid signature encoding")
+	}
+	if err := verifySignature(header.Alg, pub, []byte(msg.Protected+"."+msg.Payload), sig); err != nil {
+		if strings.HasPrefix(err.Error(), "unsupported algorithm") {
+			return nil, Problemf(ProblemBadSignatureAlgorithm, "%v", err)
+		}
+		return nil, Problemf(ProblemMalformed, "JWS verification failed: %v", err)
+	}
+	if req.payload, err = b64.DecodeString(msg.Payload); err != nil {
+		return nil, Problemf(ProblemMalformed, "invalid payload encoding")
+	}
+	return req, nil
+}
+
+func (s *Server) accountJSON(a *account) interface{} {
+	return map[string]interface{}{
+		"status":  a.Status,
+		"contact": a.Contact,
+		"orders":  s.url("/account/%s/orders", a.ID),
+	}
+}
+
+func (s *Server) newAccount(w http.ResponseWriter, r *http.Request) {
+	req, p := s.parse(r, true)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	var payload struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.problem(w, Problemf(ProblemMalformed, "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := req.key.thumbprint()
+	var acct account
+	err := s.Store.ACME("account", id, &acct)
+	switch {
+	case err == nil:
+		s.write(w, http.StatusOK, s.url("/account/%s", id), s.accountJSON(&acct))
+		return
+	case err != db.ErrNotFound:
+		s.problem(w, s.internal(err))
+		return
+	case payload.OnlyReturnExisting:
+		s.problem(w, Problemf(ProblemAccountDoesNotExist, "no account for this key"))
+		return
+	}
+	for _, c := range payload.Contact {
+		if !strings.HasPrefix(c, "mailto:") {
+			s.problem(w, Problemf(ProblemUnsupportedContact, "unsupported contact %q", c))
+			return
+		}
+	}
+	acct = account{
+		ID:        id,
+		Key:       *req.key,
+		Status:    StatusValid,
+		Contact:   payload.Contact,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := s.Store.PutACME("account", id, &acct); err != nil {
+		s.problem(w, s.internal(err))
+		return
+	}
+	s.write(w, http.StatusCreated, s.url("/account/%s", id), s.accountJSON(&acct))
+}
+
+// updateAccount handle account POST-as-GET, contact update and
+// deactivation.
+func (s *Server) updateAccount(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	if req.account.ID != id {
+		s.problem(w, Problemf(ProblemUnauthorized, "account mismatch"))
+		return
+	}
+	if len(req.payload) > 0 {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		if err := json.Unmarshal(req.payload, &payload); err != nil {
+			s.problem(w, Problemf(ProblemMalformed, "%v", err))
+			return
+		}
+		switch payload.Status {
+		case "":
+		case StatusDeactivated:
+			req.account.Status = StatusDeactivated
+		default:
+			s.problem(w, Problemf(ProblemMalformed, "invalid status %q", payload.Status))
+			return
+		}
+		if payload.Contact != nil {
+			req.account.Contact = payload.Contact
+		}
+		s.mu.Lock()
+		err := s.Store.PutACME("account", id, req.account)
+		s.mu.Unlock()
+		if err != nil {
+			s.problem(w, s.internal(err))
+			return
+		}
+	}
+	s.write(w, http.StatusOK, "", s.accountJSON(req.account))
+}
+
+func (s *Server) accountOrders(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	if req.account.ID != id {
+		s.problem(w, Problemf(ProblemUnauthorized, "account mismatch"))
+		return
+	}
+	urls := []string{}
+	for _, o := range req.account.Orders {
+		urls = append(urls, s.url("/order/%s", o))
+	}
+	s.write(w, http.StatusOK, "", map[string]interface{}{"orders": urls})
+}
+
+func (s *Server) orderJSON(o *order) interface{} {
+	authz := []string{}
+	for _, id := range o.Authorizations {
+		authz = append(authz, s.url("/authz/%s", id))
+	}
+	v := map[string]interface{}{
+		"status":         o.Status,
+		"expires":        o.Expires.Format(time.RFC3339),
+		"identifiers":    o.Identifiers,
+		"authorizations": authz,
+		"finalize":       s.url("/order/%s/finalize", o.ID),
+	}
+	if o.Error != nil {
+		v["error"] = o.Error
+	}
+	if o.Certificate != nil {
+		v["certificate"] = s.url("/cert/%s", o.ID)
+	}
+	return v
+}
+
+// newOrder create the order and one authorization per identifier,
+// pre-authorized identifiers are valid at once.
+func (s *Server) newOrder(w http.ResponseWriter, r *http.Request) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	var payload struct {
+		Identifiers []Identifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.problem(w, Problemf(ProblemMalformed, "%v", err))
+		return
+	}
+	if len(payload.Identifiers) == 0 {
+		s.problem(w, Problemf(ProblemMalformed, "no identifiers"))
+		return
+	}
+	seen := make(map[string]bool)
+	var identifiers []Identifier
+	for _, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			s.problem(w, Problemf(ProblemUnsupportedIdentifier, "identifier type %q not supported", id.Type))
+			return
+		}
+		name := strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if !validName(name) {
+			s.problem(w, Problemf(ProblemRejectedIdentifier, "invalid name %q", id.Value))
+			return
+		}
+		if !seen[name] {
+			seen[name] = true
+			identifiers = append(identifiers, Identifier{Type: "dns", Value: name})
+		}
+	}
+	sort.Slice(identifiers, func(i, j int) bool { return identifiers[i].Value < identifiers[j].Value })
+
+	now := time.Now().UTC()
+	o := &order{
+		ID:          newID(),
+		Account:     req.account.ID,
+		Status:      StatusPending,
+		Expires:     now.Add(orderLifetime),
+		Identifiers: identifiers,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range identifiers {
+		z := &authorization{
+			ID:         newID(),
+			Account:    req.account.ID,
+			Identifier: id,
+			Status:     StatusPending,
+			Expires:    o.Expires,
+		}
+		if strings.HasPrefix(id.Value, "*.") {
+			z.Wildcard = true
+			z.Identifier.Value = id.Value[2:]
+		}
+		if s.PreAuthorized != nil && s.PreAuthorized(id.Value) {
+			z.Status = StatusValid
+			z.Challenges = []challenge{}
+		} else {
+			if !z.Wildcard {
+				z.Challenges = append(z.Challenges, challenge{Type: ChallengeHTTP01, Token: newID(), Status: StatusPending})
+			}
+			z.Challenges = append(z.Challenges, challenge{Type: ChallengeDNS01, Token: newID(), Status: StatusPending})
+		}
+		if err := s.Store.PutACME("authz", z.ID, z); err != nil {
+			s.problem(w, s.internal(err))
+			return
+		}
+		o.Authorizations = append(o.Authorizations, z.ID)
+	}
+	if err := s.refreshOrder(o); err != nil {
+		s.problem(w, s.internal(err))
+		return
+	}
+	req.account.Orders = append(req.account.Orders, o.ID)
+	if err := s.Store.PutACME("account", req.account.ID, req.account); err != nil {
+		s.problem(w, s.internal(err))
+		return
+	}
+	s.write(w, http.StatusCreated, s.url("/order/%s", o.ID), s.orderJSON(o))
+}
+
+// refreshOrder update the order status from its authorizations and save
+// it. The caller hold s.mu.
+func (s *Server) refreshOrder(o *order) error {
+	if o.Status == StatusPending {
+		ready := true
+		for _, id := range o.Authorizations {
+			var z authorization
+			if err := s.Store.ACME("authz", id, &z); err != nil {
+				return err
+			}
+			switch z.Status {
+			case StatusValid:
+			case StatusPending:
+				ready = false
+			default:
+				o.Status = StatusInvalid
+				o.Error = Problemf(ProblemUnauthorized, "authorization for %s is %s", z.Identifier.Value, z.Status)
+			}
+		}
+		if o.Status == StatusPending && ready {
+			o.Status = StatusReady
+		}
+	}
+	if (o.Status == StatusPending || o.Status == StatusReady) && time.Now().After(o.Expires) {
+		o.Status = StatusInvalid
+		o.Error = Problemf(ProblemMalformed, "order expired")
+	}
+	return s.Store.PutACME("order", o.ID, o)
+}
+
+// loadOrder return the order id of the account after updating its status.
+func (s *Server) loadOrder(acct *account, id string) (*order, *Problem) {
+	var o order
+	if err := s.Store.ACME("order", id, &o); err == db.ErrNotFound {
+		return nil, &Problem{Type: errorNS + "malformed", Detail: "unknown order", Status: http.StatusNotFound}
+	} else if err != nil {
+		return nil, s.internal(err)
+	}
+	if o.Account != acct.ID {
+		return nil, Problemf(ProblemUnauthorized, "order belongs to another account")
+	}
+	if err := s.refreshOrder(&o); err != nil {
+		return nil, s.internal(err)
+	}
+	return &o, nil
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	s.mu.Lock()
+	o, p := s.loadOrder(req.account, id)
+	s.mu.Unlock()
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	s.write(w, http.StatusOK, "", s.orderJSON(o))
+}
+
+// finalize check the CSR names match the order and issue the certificate.
+func (s *Server) finalize(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	if err := json.Unmarshal(req.payload, &payload); err != nil {
+		s.problem(w, Problemf(ProblemMalformed, "%v", err))
+		return
+	}
+	der, err := b64.DecodeString(payload.CSR)
+	if err != nil {
+		s.problem(w, Problemf(ProblemBadCSR, "invalid csr encoding"))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		s.problem(w, Problemf(ProblemBadCSR, "%v", err))
+		return
+	}
+	if err = csr.CheckSignature(); err != nil {
+		s.problem(w, Problemf(ProblemBadCSR, "%v", err))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, p := s.loadOrder(req.account, id)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	if o.Status != StatusReady {
+		s.problem(w, Problemf(ProblemOrderNotReady, "order is %s", o.Status))
+		return
+	}
+	if err := checkCSRNames(csr, o.Identifiers); err != nil {
+		s.problem(w, Problemf(ProblemBadCSR, "%v", err))
+		return
+	}
+
+	cert, err := s.Issue(csr, "acme:"+req.account.ID)
+	if err != nil {
+		o.Status = StatusInvalid
+		if perr, ok := err.(*Problem); ok {
+			o.Error = perr
+		} else {
+			o.Error = s.internal(err)
+		}
+		if err := s.Store.PutACME("order", o.ID, o); err != nil {
+			s.problem(w, s.internal(err))
+			return
+		}
+		s.problem(w, o.Error)
+		return
+	}
+	o.Status = StatusValid
+	o.Certificate = cert.Raw
+	if err := s.Store.PutACME("order", o.ID, o); err != nil {
+		s.problem(w, s.internal(err))
+		return
+	}
+	s.write(w, http.StatusOK, s.url("/order/%s", o.ID), s.orderJSON(o))
+}
+
+// checkCSRNames require the CSR to request exactly the order identifiers.
+func checkCSRNames(csr *x509.CertificateRequest, identifiers []Identifier) error {
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return fmt.Errorf("only dns names are allowed")
+	}
+	want := make(map[string]bool)
+	for _, id := range identifiers {
+		want[id.Value] = true
+	}
+	got := make(map[string]bool)
+	for _, name := range csr.DNSNames {
+		got[strings.ToLower(name)] = true
+	}
+	if cn := strings.ToLower(csr.Subject.CommonName); cn != "" {
+		if !want[cn] {
+			return fmt.Errorf("common name %s is not in the order", cn)
+		}
+		got[cn] = true
+	}
+	for name := range got {
+		if !want[name] {
+			return fmt.Errorf("%s is not in the order", name)
+		}
+	}
+	for name := range want {
+		if !got[name] {
+			return fmt.Errorf("%s is missing from the csr", name)
+		}
+	}
+	return nil
+}
+
+func (s *Server) authorizationJSON(z *authorization) interface{} {
+	challenges := []interface{}{}
+	for i := range z.Challenges {
+		challenges = append(challenges, s.challengeJSON(z, &z.Challenges[i]))
+	}
+	v := map[string]interface{}{
+		"identifier": z.Identifier,
+		"status":     z.Status,
+		"expires":    z.Expires.Format(time.RFC3339),
+		"challenges": challenges,
+	}
+	if z.Wildcard {
+		v["wildcard"] = true
+	}
+	return v
+}
+
+func (s *Server) challengeJSON(z *authorization, c *challenge) interface{} {
+	v := map[string]interface{}{
+		"type":   c.Type,
+		"url":    s.url("/chall/%s/%s", z.ID, c.Type),
+		"status": c.Status,
+		"token":  c.Token,
+	}
+	if c.Validated != nil {
+		v["validated"] = c.Validated.Format(time.RFC3339)
+	}
+	if c.Error != nil {
+		v["error"] = c.Error
+	}
+	return v
+}
+
+// loadAuthorization return the authorization id of the account. The
+// caller hold s.mu.
+func (s *Server) loadAuthorization(acct *account, id string) (*authorization, *Problem) {
+	var z authorization
+	if err := s.Store.ACME("authz", id, &z); err == db.ErrNotFound {
+		return nil, &Problem{Type: errorNS + "malformed", Detail: "unknown authorization", Status: http.StatusNotFound}
+	} else if err != nil {
+		return nil, s.internal(err)
+	}
+	if z.Account != acct.ID {
+		return nil, Problemf(ProblemUnauthorized, "authorization belongs to another account")
+	}
+	if z.Status == StatusPending && time.Now().After(z.Expires) {
+		z.Status = StatusInvalid
+		if err := s.Store.PutACME("authz", z.ID, &z); err != nil {
+			return nil, s.internal(err)
+		}
+	}
+	return &z, nil
+}
+
+func (s *Server) getAuthorization(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	s.mu.Lock()
+	z, p := s.loadAuthorization(req.account, id)
+	s.mu.Unlock()
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	if z.Status == StatusPending {
+		w.Header().Set("Retry-After", "2")
+	}
+	s.write(w, http.StatusOK, "", s.authorizationJSON(z))
+}
+
+// postChallenge start the validation of a pending challenge, other
+// requests are POST-as-GET.
+func (s *Server) postChallenge(w http.ResponseWriter, r *http.Request, authzID, typ string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, p := s.loadAuthorization(req.account, authzID)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	var c *challenge
+	for i := range z.Challenges {
+		if z.Challenges[i].Type == typ {
+			c = &z.Challenges[i]
+		}
+	}
+	if c == nil {
+		s.problem(w, &Problem{Type: errorNS + "malformed", Detail: "unknown challenge", Status: http.StatusNotFound})
+		return
+	}
+	if len(req.payload) > 0 && c.Status == StatusPending && z.Status == StatusPending {
+		c.Status = StatusProcessing
+		if err := s.Store.PutACME("authz", z.ID, z); err != nil {
+			s.problem(w, s.internal(err))
+			return
+		}
+		go s.validate(z.ID, typ, keyAuthorization(c.Token, &req.account.Key))
+	}
+	if c.Status == StatusProcessing {
+		w.Header().Set("Retry-After", "2")
+	}
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"up\"", s.url("/authz/%s", z.ID)))
+	s.write(w, http.StatusOK, "", s.challengeJSON(z, c))
+}
+
+func (s *Server) getCertificate(w http.ResponseWriter, r *http.Request, id string) {
+	req, p := s.parse(r, false)
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	s.mu.Lock()
+	o, p := s.loadOrder(req.account, id)
+	s.mu.Unlock()
+	if p != nil {
+		s.problem(w, p)
+		return
+	}
+	if o.Certificate == nil {
+		s.problem(w, &Problem{Type: errorNS + "malformed", Detail: "no certificate", Status: http.StatusNotFound})
+		return
+	}
+	w.Header().Set("Replay-Nonce", s.nonces.next())
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.url("/directory")))
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: o.Certificate})
+	for _, der := range s.Chain {
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+}
+
+// MatchNames return a PreAuthorized function matching the names in
+// entries, the entries starting with a dot match any name under that
+// domain. Names are compared in lower case.
+func MatchNames(entries []string) func(name string) bool {
+	return func(name string) bool {
+		name = strings.ToLower(name)
+		for _, entry := range entries {
+			entry = strings.ToLower(entry)
+			if name == entry || strings.HasPrefix(entry, ".") && strings.HasSuffix(name, entry) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// validName accept dns names, with an optional leading wildcard label.
+func validName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,321 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ezbastion/ezb_pki/db"
+)
+
+const testBaseURL = "https://acme.test/acme"
+
+// newTestServer return a server with a store in a temporary folder,
+// removed by the returned function.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := db.Open(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return &Server{BaseURL: testBaseURL, Store: store}, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// pad32 return the 32 bytes big-endian encoding of n.
+func pad32(n *big.Int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func testJWK(key *ecdsa.PrivateKey) *jsonWebKey {
+	return &jsonWebKey{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(pad32(key.X)), Y: b64.EncodeToString(pad32(key.Y))}
+}
+
+// signJWS return the flattened JWS of payload signed by key with ES256.
+func signJWS(t *testing.T, key *ecdsa.PrivateKey, header jwsHeader, payload string) *jws {
+	protected, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &jws{Protected: b64.EncodeToString(protected), Payload: b64.EncodeToString([]byte(payload))}
+	digest := sha256.Sum256([]byte(msg.Protected + "." + msg.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Signature = b64.EncodeToString(append(pad32(r), pad32(s)...))
+	return msg
+}
+
+func jwsRequest(t *testing.T, path string, msg *jws) *http.Request {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(body)))
+	r.Header.Set("Content-Type", "application/jose+json")
+	return r
+}
+
+func TestParse(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	key, other := newTestKey(t), newTestKey(t)
+	for id, status := range map[string]string{"valid": StatusValid, "deactivated": StatusDeactivated} {
+		acct := &account{ID: id, Key: *testJWK(key), Status: status}
+		if err := s.Store.PutACME("account", id, acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := s.nonces.next()
+	if !s.nonces.use(used) {
+		t.Fatal("fresh nonce refused")
+	}
+
+	tests := []struct {
+		name       string
+		newAccount bool
+		path       string
+		key        *ecdsa.PrivateKey
+		header     func(nonce string) jwsHeader
+		tamper     func(msg *jws)
+		want       string
+	}{
+		{
+			name: "new account", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+		},
+		{
+			name: "account request", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", KID: testBaseURL + "/account/valid"}
+			},
+		},
+		{
+			name: "bad signature", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+			tamper: func(msg *jws) {
+				sig, _ := b64.DecodeString(msg.Signature)
+				sig[len(sig)-1] ^= 1
+				msg.Signature = b64.EncodeToString(sig)
+			},
+			want: ProblemMalformed,
+		},
+		{
+			name: "payload replaced", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+			tamper: func(msg *jws) { msg.Payload = b64.EncodeToString([]byte(`{"contact":[]}`)) },
+			want:   ProblemMalformed,
+		},
+		{
+			name: "signed by another key", path: "/new-order", key: other,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", KID: testBaseURL + "/account/valid"}
+			},
+			want: ProblemMalformed,
+		},
+		{
+			name: "unsupported algorithm", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "none", Nonce: nonce, URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+			want: ProblemBadSignatureAlgorithm,
+		},
+		{
+			name: "reused nonce", newAccount: true, path: "/new-account", key: key,
+			header: func(string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: used, URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+			want: ProblemBadNonce,
+		},
+		{
+			name: "unknown nonce", newAccount: true, path: "/new-account", key: key,
+			header: func(string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: "unknown", URL: testBaseURL + "/new-account", JWK: testJWK(key)}
+			},
+			want: ProblemBadNonce,
+		},
+		{
+			name: "url of another resource", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-account", KID: testBaseURL + "/account/valid"}
+			},
+			want: ProblemUnauthorized,
+		},
+		{
+			name: "url of another server", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: "https://other.test/acme/new-account", JWK: testJWK(key)}
+			},
+			want: ProblemUnauthorized,
+		},
+		{
+			name: "new account with kid", newAccount: true, path: "/new-account", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-account", JWK: testJWK(key), KID: testBaseURL + "/account/valid"}
+			},
+			want: ProblemMalformed,
+		},
+		{
+			name: "jwk instead of kid", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", JWK: testJWK(key)}
+			},
+			want: ProblemMalformed,
+		},
+		{
+			name: "kid of another server", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", KID: "https://other.test/acme/account/valid"}
+			},
+			want: ProblemAccountDoesNotExist,
+		},
+		{
+			name: "unknown account", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", KID: testBaseURL + "/account/unknown"}
+			},
+			want: ProblemAccountDoesNotExist,
+		},
+		{
+			name: "deactivated account", path: "/new-order", key: key,
+			header: func(nonce string) jwsHeader {
+				return jwsHeader{Alg: "ES256", Nonce: nonce, URL: testBaseURL + "/new-order", KID: testBaseURL + "/account/deactivated"}
+			},
+			want: ProblemUnauthorized,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := signJWS(t, test.key, test.header(s.nonces.next()), `{}`)
+			if test.tamper != nil {
+				test.tamper(msg)
+			}
+			_, p := s.parse(jwsRequest(t, test.path, msg), test.newAccount)
+			switch {
+			case test.want == "" && p != nil:
+				t.Fatalf("unexpected problem %v", p)
+			case test.want != "" && p == nil:
+				t.Fatalf("accepted, want %s", test.want)
+			case test.want != "" && p.Type != errorNS+test.want:
+				t.Fatalf("problem %v, want %s", p, test.want)
+			}
+		})
+	}
+}
+
+func TestNonceSingleUse(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+	key := newTestKey(t)
+	msg := signJWS(t, key, jwsHeader{Alg: "ES256", Nonce: s.nonces.next(), URL: testBaseURL + "/new-account", JWK: testJWK(key)}, `{}`)
+	if _, p := s.parse(jwsRequest(t, "/new-account", msg), true); p != nil {
+		t.Fatalf("first use: %v", p)
+	}
+	_, p := s.parse(jwsRequest(t, "/new-account", msg), true)
+	if p == nil || p.Type != errorNS+ProblemBadNonce {
+		t.Fatalf("replay: got %v, want %s", p, ProblemBadNonce)
+	}
+}
+
+func TestCheckCSRNames(t *testing.T) {
+	order := []Identifier{{Type: "dns", Value: "node.domain"}, {Type: "dns", Value: "*.apps.domain"}}
+	tests := []struct {
+		name string
+		csr  x509.CertificateRequest
+		ok   bool
+	}{
+		{"exact names", x509.CertificateRequest{DNSNames: []string{"node.domain", "*.apps.domain"}}, true},
+		{"common name in order", x509.CertificateRequest{Subject: pkix.Name{CommonName: "node.domain"}, DNSNames: []string{"*.apps.domain"}}, true},
+		{"mixed case", x509.CertificateRequest{DNSNames: []string{"Node.Domain", "*.APPS.domain"}}, true},
+		{"common name not in order", x509.CertificateRequest{Subject: pkix.Name{CommonName: "other.domain"}, DNSNames: []string{"node.domain", "*.apps.domain"}}, false},
+		{"missing name", x509.CertificateRequest{DNSNames: []string{"node.domain"}}, false},
+		{"extra name", x509.CertificateRequest{DNSNames: []string{"node.domain", "*.apps.domain", "other.domain"}}, false},
+		{"wildcard for a single name", x509.CertificateRequest{DNSNames: []string{"node.domain", "x.apps.domain"}}, false},
+		{"ip address", x509.CertificateRequest{DNSNames: []string{"node.domain", "*.apps.domain"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+		{"email address", x509.CertificateRequest{DNSNames: []string{"node.domain", "*.apps.domain"}, EmailAddresses: []string{"a@domain"}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkCSRNames(&test.csr, order)
+			if test.ok && err != nil {
+				t.Fatalf("refused: %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestMatchNames(t *testing.T) {
+	match := MatchNames([]string{".Corp.Local", "jump.domain"})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"jump.domain", true},
+		{"JUMP.domain", true},
+		{"x.jump.domain", false},
+		{"node.corp.local", true},
+		{"a.b.corp.local", true},
+		{"*.corp.local", true},
+		{"corp.local", false},
+		{"evilcorp.local", false},
+		{"node.corp.local.evil", false},
+	}
+	for _, test := range tests {
+		if got := match(test.name); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
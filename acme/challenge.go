@@ -0,0 +1,121 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const validationTimeout = 10 * time.Second
+
+// keyAuthorization is the expected challenge response, RFC 8555 section 8.1.
+func keyAuthorization(token string, key *jsonWebKey) string {
+	return token + "." + key.thumbprint()
+}
+
+// validate check the challenge typ of the authorization and record the
+// outcome.
+func (s *Server) validate(authzID, typ, keyAuth string) {
+	s.mu.Lock()
+	var z authorization
+	err := s.Store.ACME("authz", authzID, &z)
+	s.mu.Unlock()
+	if err != nil {
+		s.internal(err)
+		return
+	}
+
+	var p *Problem
+	switch typ {
+	case ChallengeHTTP01:
+		p = validateHTTP01(z.Identifier.Value, keyAuth)
+	case ChallengeDNS01:
+		p = validateDNS01(z.Identifier.Value, keyAuth)
+	default:
+		p = Problemf(ProblemMalformed, "unsupported challenge %s", typ)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.Store.ACME("authz", authzID, &z); err != nil {
+		s.internal(err)
+		return
+	}
+	for i := range z.Challenges {
+		c := &z.Challenges[i]
+		if c.Type != typ || c.Status != StatusProcessing {
+			continue
+		}
+		if p != nil {
+			c.Status = StatusInvalid
+			c.Error = p
+			z.Status = StatusInvalid
+		} else {
+			now := time.Now().UTC()
+			c.Status = StatusValid
+			c.Validated = &now
+			z.Status = StatusValid
+		}
+	}
+	if err := s.Store.PutACME("authz", authzID, &z); err != nil {
+		s.internal(err)
+	}
+}
+
+// validateHTTP01 fetch the key authorization from the domain web server.
+func validateHTTP01(domain, keyAuth string) *Problem {
+	token := keyAuth[:strings.Index(keyAuth, ".")]
+	client := &http.Client{Timeout: validationTimeout}
+	resp, err := client.Get("http://" + domain + "/.well-known/acme-challenge/" + token)
+	if err != nil {
+		return Problemf(ProblemConnection, "%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Problemf(ProblemIncorrectResponse, "http-01 challenge returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if err != nil {
+		return Problemf(ProblemConnection, "%v", err)
+	}
+	if got := strings.TrimSpace(string(body)); got != keyAuth {
+		return Problemf(ProblemIncorrectResponse, "http-01 key authorization mismatch, got %q", got)
+	}
+	return nil
+}
+
+// validateDNS01 look up the key authorization digest in the
+// _acme-challenge TXT records of the domain.
+func validateDNS01(domain, keyAuth string) *Problem {
+	h := sha256.Sum256([]byte(keyAuth))
+	want := b64.EncodeToString(h[:])
+	records, err := net.LookupTXT("_acme-challenge." + domain)
+	if err != nil {
+		return Problemf(ProblemDNS, "%v", err)
+	}
+	for _, txt := range records {
+		if txt == want {
+			return nil
+		}
+	}
+	return Problemf(ProblemIncorrectResponse, "no TXT record matching the key authorization for _acme-challenge.%s", domain)
+}
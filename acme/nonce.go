@@ -0,0 +1,66 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	nonceLifetime = time.Hour
+	maxNonces     = 100000
+)
+
+// nonces is the set of issued and not yet used anti-replay nonces. They
+// are kept in memory, clients retry on badNonce after a restart.
+type nonces struct {
+	mu     sync.Mutex
+	issued map[string]time.Time
+}
+
+func (n *nonces) next() string {
+	nonce := newID()
+	now := time.Now()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.issued == nil {
+		n.issued = make(map[string]time.Time)
+	}
+	if len(n.issued) >= maxNonces {
+		for k, t := range n.issued {
+			if now.Sub(t) > nonceLifetime {
+				delete(n.issued, k)
+			}
+		}
+	}
+	if len(n.issued) < maxNonces {
+		n.issued[nonce] = now
+	}
+	return nonce
+}
+
+// use consume nonce, false if it is unknown or expired.
+func (n *nonces) use(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	t, ok := n.issued[nonce]
+	if !ok {
+		return false
+	}
+	delete(n.issued, nonce)
+	return time.Since(t) <= nonceLifetime
+}
@@ -0,0 +1,77 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package acme
+
+import (
+	"fmt"
+	"net/http"
+)
+
+const errorNS = "urn:ietf:params:acme:error:"
+
+// Problem types used by the server, RFC 8555 section 6.7.
+const (
+	ProblemAccountDoesNotExist   = "accountDoesNotExist"
+	ProblemBadCSR                = "badCSR"
+	ProblemBadNonce              = "badNonce"
+	ProblemBadPublicKey          = "badPublicKey"
+	ProblemBadSignatureAlgorithm = "badSignatureAlgorithm"
+	ProblemConnection            = "connection"
+	ProblemDNS                   = "dns"
+	ProblemIncorrectResponse     = "incorrectResponse"
+	ProblemMalformed             = "malformed"
+	ProblemOrderNotReady         = "orderNotReady"
+	ProblemRejectedIdentifier    = "rejectedIdentifier"
+	ProblemServerInternal        = "serverInternal"
+	ProblemUnauthorized          = "unauthorized"
+	ProblemUnsupportedContact    = "unsupportedContact"
+	ProblemUnsupportedIdentifier = "unsupportedIdentifier"
+)
+
+var problemStatus = map[string]int{
+	ProblemAccountDoesNotExist: http.StatusBadRequest,
+	ProblemOrderNotReady:       http.StatusForbidden,
+	ProblemServerInternal:      http.StatusInternalServerError,
+	ProblemUnauthorized:        http.StatusForbidden,
+}
+
+// Problem is an RFC 7807 problem document.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return p.Type + ": " + p.Detail
+}
+
+// Problemf return a problem of the ACME error typ.
+func Problemf(typ string, format string, args ...interface{}) *Problem {
+	status, ok := problemStatus[typ]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	return &Problem{Type: errorNS + typ, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+// internal log err and hide it from the client.
+func (s *Server) internal(err error) *Problem {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+	return Problemf(ProblemServerInternal, "internal error")
+}
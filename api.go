@@ -0,0 +1,410 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+const apiPrefix = "/api/v1/"
+
+// apiCertificate is the API view of an inventory record.
+type apiCertificate struct {
+	Serial           string    `json:"serial"`
+	CommonName       string    `json:"commonname"`
+	Subject          string    `json:"subject"`
+	DNSNames         []string  `json:"dnsnames,omitempty"`
+	IPAddresses      []string  `json:"ipaddresses,omitempty"`
+	Emails           []string  `json:"emails,omitempty"`
+	URIs             []string  `json:"uris,omitempty"`
+	Fingerprint      string    `json:"fingerprint"`
+	NotBefore        time.Time `json:"notbefore"`
+	NotAfter         time.Time `json:"notafter"`
+	Profile          string    `json:"profile,omitempty"`
+	Requester        string    `json:"requester"`
+	Status           string    `json:"status"`
+	IssuedAt         time.Time `json:"issuedat"`
+	RevokedAt        time.Time `json:"revokedat,omitempty"`
+	RevocationReason string    `json:"revocationreason,omitempty"`
+	Renews           string    `json:"renews,omitempty"`
+	RenewedBy        string    `json:"renewedby,omitempty"`
+	PEM              string    `json:"pem,omitempty"`
+}
+
+func newAPICertificate(rec *models.Certificate, withPEM bool) *apiCertificate {
+	c := &apiCertificate{
+		Serial:      rec.Serial,
+		CommonName:  rec.CommonName,
+		Subject:     rec.Subject,
+		DNSNames:    rec.DNSNames,
+		IPAddresses: rec.IPAddresses,
+		Emails:      rec.Emails,
+		URIs:        rec.URIs,
+		Fingerprint: rec.Fingerprint,
+		NotBefore:   rec.NotBefore,
+		NotAfter:    rec.NotAfter,
+		Profile:     rec.Profile,
+		Requester:   rec.Requester,
+		Status:      rec.CurrentStatus(time.Now()),
+		IssuedAt:    rec.IssuedAt,
+		Renews:      rec.Renews,
+		RenewedBy:   rec.RenewedBy,
+	}
+	if rec.Status == models.StatusRevoked {
+		c.RevokedAt = rec.RevokedAt
+		c.RevocationReason = ca.ReasonString(rec.RevocationReason)
+	}
+	if withPEM {
+		c.PEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rec.Raw}))
+	}
+	return c
+}
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// startAPIServer serve the management API over TLS on conf.API.Listen
+// until stop is closed. Callers authenticate with a valid certificate of
+// one of the conf.API.Profiles profiles.
+func startAPIServer(rca *rootCA, stop <-chan bool) {
+	if conf.API.Listen == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", conf.API.Listen)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(rca.serveAPI)}
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+	log.Println("API listen at ", conf.API.Listen)
+	if err := srv.Serve(tls.NewListener(listener, rca.tlsConfig())); err != nil && err != http.ErrServerClosed {
+		log.Errorln(err)
+	}
+}
+
+func apiProfiles() []string {
+	if len(conf.API.Profiles) == 0 {
+		return []string{"admin"}
+	}
+	return conf.API.Profiles
+}
+
+// isAPIProfile tell if certificates of profile may use the API.
+func isAPIProfile(profile string) bool {
+	for _, name := range apiProfiles() {
+		if profile == name {
+			return true
+		}
+	}
+	return false
+}
+
+// apiCaller return the name of the authenticated caller.
+func (rca *rootCA) apiCaller(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", fmt.Errorf("client certificate required")
+	}
+	peer := r.TLS.PeerCertificates[0]
+	if err := rca.authorizeAdmin(peer); err != nil {
+		return "", err
+	}
+	return peer.Subject.CommonName, nil
+}
+
+// authorizeAdmin accept a valid certificate of one of the API profiles.
+func (rca *rootCA) authorizeAdmin(peer *x509.Certificate) error {
+	rec, err := rca.store.Certificate(db.SerialKey(peer.SerialNumber))
+	if err == db.ErrNotFound {
+		return fmt.Errorf("client certificate not in inventory")
+	}
+	if err != nil {
+		return err
+	}
+	if status := rec.CurrentStatus(time.Now()); status != models.StatusValid {
+		return fmt.Errorf("client certificate %s is %s", rec.Serial, status)
+	}
+	if isAPIProfile(rec.Profile) {
+		return nil
+	}
+	return fmt.Errorf("profile %s is not allowed to use the API", rec.Profile)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
+}
+
+func (rca *rootCA) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+	if len(parts) == 1 && parts[0] == "health" {
+		rca.apiHealth(w, r)
+		return
+	}
+	caller, err := rca.apiCaller(r)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, "%v", err)
+		return
+	}
+
+	route := r.Method + " " + parts[0]
+	switch {
+	case len(parts) == 2 && route == "GET ca" && parts[1] == "chain":
+		rca.apiChain(w)
+	case len(parts) == 2 && route == "GET ca" && parts[1] == "bundle":
+		rca.apiBundle(w)
+	case len(parts) == 1 && route == "GET certificates":
+		rca.apiList(w, r)
+	case len(parts) == 1 && route == "POST certificates":
+		rca.apiSubmit(w, r, caller)
+	case len(parts) == 2 && route == "GET certificates" && parts[1] == "search":
+		rca.apiSearch(w, r)
+	case len(parts) == 2 && route == "GET certificates":
+		rca.apiGet(w, parts[1])
+	case len(parts) == 3 && route == "POST certificates" && parts[2] == "revoke":
+		rca.apiRevoke(w, r, parts[1], caller)
+	default:
+		writeAPIError(w, http.StatusNotFound, "no route for %s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (rca *rootCA) apiHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	health := map[string]interface{}{
+		"status":     "ok",
+		"ca":         rca.cert.Subject.CommonName,
+		"canotafter": rca.cert.NotAfter,
+		"time":       time.Now(),
+	}
+	if _, err := rca.store.Revocations(); err != nil {
+		log.Errorln(err)
+		status = http.StatusServiceUnavailable
+		health["status"] = "inventory unavailable"
+	}
+	writeJSON(w, status, health)
+}
+
+func (rca *rootCA) apiChain(w http.ResponseWriter) {
+	var chain []string
+	for _, der := range rca.chain {
+		chain = append(chain, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"chain": chain})
+}
+
+// apiBundle return the roots and cross-certificates to trust, both roots
+// during a rollover transition.
+func (rca *rootCA) apiBundle(w http.ResponseWriter) {
+	var bundle []string
+	for _, der := range rca.bundle {
+		bundle = append(bundle, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	}
+	response := map[string]interface{}{"bundle": bundle}
+	if rca.rollover.Active() {
+		response["transitionuntil"] = rca.rollover.Until
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeCertificates(w http.ResponseWriter, list []models.Certificate) {
+	sort.Slice(list, func(i, j int) bool { return list[i].IssuedAt.Before(list[j].IssuedAt) })
+	certificates := make([]*apiCertificate, 0, len(list))
+	for i := range list {
+		certificates = append(certificates, newAPICertificate(&list[i], false))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"certificates": certificates})
+}
+
+// apiList return the inventory filtered by the cn, profile and status
+// query parameters.
+func (rca *rootCA) apiList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cn, profile, status := q.Get("cn"), q.Get("profile"), q.Get("status")
+	now := time.Now()
+	list, err := rca.store.Certificates(func(rec *models.Certificate) bool {
+		return (cn == "" || strings.EqualFold(rec.CommonName, cn)) &&
+			(profile == "" || rec.Profile == profile) &&
+			(status == "" || rec.CurrentStatus(now) == status)
+	})
+	if err != nil {
+		log.Errorln(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeCertificates(w, list)
+}
+
+// apiSearch return the certificates with a name, serial, fingerprint or
+// requester containing the q query parameter.
+func (rca *rootCA) apiSearch(w http.ResponseWriter, r *http.Request) {
+	term := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	if term == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing q parameter")
+		return
+	}
+	list, err := rca.store.Certificates(func(rec *models.Certificate) bool {
+		fields := []string{rec.Serial, rec.CommonName, rec.Subject, rec.Fingerprint, rec.Requester}
+		fields = append(fields, rec.DNSNames...)
+		fields = append(fields, rec.IPAddresses...)
+		fields = append(fields, rec.Emails...)
+		fields = append(fields, rec.URIs...)
+		for _, field := range fields {
+			if strings.Contains(strings.ToLower(field), term) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		log.Errorln(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeCertificates(w, list)
+}
+
+func (rca *rootCA) apiGet(w http.ResponseWriter, serial string) {
+	key, err := normalizeSerial(serial)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	rec, err := rca.store.Certificate(key)
+	if err == db.ErrNotFound {
+		writeAPIError(w, http.StatusNotFound, "unknown certificate %s", key)
+		return
+	}
+	if err != nil {
+		log.Errorln(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPICertificate(rec, true))
+}
+
+// apiSubmit sign a CSR on behalf of an operator, without enrollment token
+// nor approval.
+func (rca *rootCA) apiSubmit(w http.ResponseWriter, r *http.Request, caller string) {
+	var body struct {
+		CSR     string `json:"csr"`
+		Profile string `json:"profile"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, protocol.MaxFrameSize)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	der := []byte(body.CSR)
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	} else if b, err := base64.StdEncoding.DecodeString(body.CSR); err == nil {
+		der = b
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid csr: %v", err)
+		return
+	}
+	if err = csr.CheckSignature(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid csr: %v", err)
+		return
+	}
+	cert, err := rca.issueCSR(csr, body.Profile, "", "api:"+caller)
+	if perr, ok := err.(*protocol.Error); ok {
+		writeAPIError(w, http.StatusForbidden, "%s", perr.Message)
+		return
+	}
+	if err != nil {
+		log.Errorln(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	log.Printf("API: %s issued a certificate to %s, serial %s", caller, cert.Subject.CommonName, db.SerialKey(cert.SerialNumber))
+	rec, err := rca.store.Certificate(db.SerialKey(cert.SerialNumber))
+	if err != nil {
+		log.Errorln(err)
+		writeAPIError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusCreated, newAPICertificate(rec, true))
+}
+
+// apiRevoke revoke serial, the CRL is published at once.
+func (rca *rootCA) apiRevoke(w http.ResponseWriter, r *http.Request, serial string, caller string) {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	if body.Reason == "" {
+		body.Reason = "unspecified"
+	}
+	reason, err := ca.ParseReason(body.Reason)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	key, err := normalizeSerial(serial)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	err = rca.revoke(key, reason, "API: "+caller)
+	if err == db.ErrNotFound {
+		writeAPIError(w, http.StatusNotFound, "unknown certificate %s", key)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, "%v", err)
+		return
+	}
+	rca.apiGet(w, key)
+}
@@ -0,0 +1,180 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// Revocation reason codes, RFC 5280 section 5.3.1.
+const (
+	ReasonUnspecified          = 0
+	ReasonKeyCompromise        = 1
+	ReasonCACompromise         = 2
+	ReasonAffiliationChanged   = 3
+	ReasonSuperseded           = 4
+	ReasonCessationOfOperation = 5
+	ReasonCertificateHold      = 6
+	ReasonRemoveFromCRL        = 8
+	ReasonPrivilegeWithdrawn   = 9
+	ReasonAACompromise         = 10
+)
+
+var reasonNames = map[int]string{
+	ReasonUnspecified:          "unspecified",
+	ReasonKeyCompromise:        "keyCompromise",
+	ReasonCACompromise:         "cACompromise",
+	ReasonAffiliationChanged:   "affiliationChanged",
+	ReasonSuperseded:           "superseded",
+	ReasonCessationOfOperation: "cessationOfOperation",
+	ReasonCertificateHold:      "certificateHold",
+	ReasonRemoveFromCRL:        "removeFromCRL",
+	ReasonPrivilegeWithdrawn:   "privilegeWithdrawn",
+	ReasonAACompromise:         "aACompromise",
+}
+
+var (
+	oidExtensionAuthorityKeyID = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidExtensionCRLNumber      = asn1.ObjectIdentifier{2, 5, 29, 20}
+	oidExtensionReasonCode     = asn1.ObjectIdentifier{2, 5, 29, 21}
+)
+
+// ParseReason accept a reason code by RFC 5280 name (case insensitive) or
+// number. removeFromCRL is refused, it is only meaningful in delta CRLs.
+func ParseReason(s string) (int, error) {
+	reason := -1
+	if n, err := strconv.Atoi(s); err == nil {
+		if _, ok := reasonNames[n]; ok {
+			reason = n
+		}
+	}
+	for code, name := range reasonNames {
+		if strings.EqualFold(name, s) {
+			reason = code
+		}
+	}
+	switch reason {
+	case -1:
+		return 0, fmt.Errorf("unknown revocation reason %q", s)
+	case ReasonRemoveFromCRL:
+		return 0, fmt.Errorf("revocation reason %s is only valid in delta CRLs", reasonNames[reason])
+	}
+	return reason, nil
+}
+
+// ReasonString return the RFC 5280 name of a reason code.
+func ReasonString(reason int) string {
+	if name, ok := reasonNames[reason]; ok {
+		return name
+	}
+	return strconv.Itoa(reason)
+}
+
+// ReasonNames list the accepted reason names.
+func ReasonNames() []string {
+	names := make([]string, 0, len(reasonNames))
+	for code := 0; code <= ReasonAACompromise; code++ {
+		if name, ok := reasonNames[code]; ok && code != ReasonRemoveFromCRL {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+type authorityKeyID struct {
+	ID []byte `asn1:"optional,tag:0"`
+}
+
+// CreateCRL sign a DER encoded v2 CRL listing the revoked records.
+// The CRL is built by hand because roots generated by older releases lack
+// the cRLSign key usage, which x509.CreateRevocationList insists on.
+func CreateCRL(issuer *x509.Certificate, key crypto.Signer, revoked []models.Certificate, number *big.Int, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	var issuerName pkix.RDNSequence
+	if _, err := asn1.Unmarshal(issuer.RawSubject, &issuerName); err != nil {
+		return nil, err
+	}
+	_, algo, _, err := SignatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, rec := range revoked {
+		serial, ok := new(big.Int).SetString(rec.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in inventory", rec.Serial)
+		}
+		entry := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: rec.RevokedAt.UTC(),
+		}
+		if rec.RevocationReason != ReasonUnspecified {
+			value, err := asn1.Marshal(asn1.Enumerated(rec.RevocationReason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: value}}
+		}
+		entries = append(entries, entry)
+	}
+
+	crlNumber, err := asn1.Marshal(number)
+	if err != nil {
+		return nil, err
+	}
+	extensions := []pkix.Extension{{Id: oidExtensionCRLNumber, Value: crlNumber}}
+	if len(issuer.SubjectKeyId) > 0 {
+		aki, err := asn1.Marshal(authorityKeyID{ID: issuer.SubjectKeyId})
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, pkix.Extension{Id: oidExtensionAuthorityKeyID, Value: aki})
+	}
+
+	tbs := pkix.TBSCertificateList{
+		Version:             1,
+		Signature:           algo,
+		Issuer:              issuerName,
+		ThisUpdate:          thisUpdate.UTC(),
+		NextUpdate:          nextUpdate.UTC(),
+		RevokedCertificates: entries,
+		Extensions:          extensions,
+	}
+	tbsDER, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+	algo, signature, err := sign(key, tbsDER)
+	if err != nil {
+		return nil, err
+	}
+	tbs.Raw = tbsDER
+	return asn1.Marshal(pkix.CertificateList{
+		TBSCertList:        tbs,
+		SignatureAlgorithm: algo,
+		SignatureValue:     signature,
+	})
+}
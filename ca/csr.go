@@ -0,0 +1,59 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+)
+
+var oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+
+type tbsCertificateRequest struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []csrAttribute `asn1:"tag:0,set"`
+}
+
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// ChallengePassword return the PKCS#9 challengePassword attribute of csr,
+// an empty string when the attribute is absent.
+func ChallengePassword(csr *x509.CertificateRequest) (string, error) {
+	var tbs tbsCertificateRequest
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &tbs); err != nil {
+		return "", err
+	}
+	for _, attr := range tbs.Attributes {
+		if !attr.Type.Equal(oidChallengePassword) {
+			continue
+		}
+		if len(attr.Values) != 1 {
+			return "", errors.New("challengePassword must have a single value")
+		}
+		var password string
+		if _, err := asn1.Unmarshal(attr.Values[0].FullBytes, &password); err != nil {
+			return "", err
+		}
+		return password, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,279 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// OCSP response status, RFC 6960 section 4.2.1.
+const (
+	ocspSuccessful       = 0
+	ocspMalformedRequest = 1
+	ocspInternalError    = 2
+	ocspUnauthorized     = 6
+)
+
+var (
+	oidOCSPBasic   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidOCSPNonce   = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+	oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+	oidHashSHA1    = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidHashSHA256  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidHashSHA384  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidHashSHA512  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	ocspHashByOID  = map[string]crypto.Hash{
+		oidHashSHA1.String():   crypto.SHA1,
+		oidHashSHA256.String(): crypto.SHA256,
+		oidHashSHA384.String(): crypto.SHA384,
+		oidHashSHA512.String(): crypto.SHA512,
+	}
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspSingleRequest struct {
+	Cert       ocspCertID
+	Extensions []pkix.Extension `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspTBSRequest struct {
+	Version       int           `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName asn1.RawValue `asn1:"explicit,tag:1,optional"`
+	RequestList   []ocspSingleRequest
+	Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+	Signature  asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw         asn1.RawContent
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+// OCSPResponder answer RFC 6960 requests about the certificates of Issuer
+// from the inventory.
+type OCSPResponder struct {
+	Issuer *x509.Certificate
+	// Signer sign the responses, it is the CA key or the key of
+	// Certificate, a delegated OCSP signing certificate.
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+	// Lookup return the inventory record of a serial, nil if unknown.
+	Lookup   func(serial *big.Int) (*models.Certificate, error)
+	Validity time.Duration
+	// Previous answer the requests about the certificates of the previous
+	// root after a rollover, nil if none.
+	Previous *OCSPResponder
+}
+
+// Respond return the DER encoded OCSP response to a DER encoded request.
+// Errors are reported to the client as OCSP response status.
+func (r *OCSPResponder) Respond(der []byte) []byte {
+	var req ocspRequest
+	rest, err := asn1.Unmarshal(der, &req)
+	if err != nil || len(rest) > 0 || len(req.TBSRequest.RequestList) == 0 {
+		return ocspStatus(ocspMalformedRequest)
+	}
+
+	if r.Previous != nil && r.Previous.issuedAll(req.TBSRequest.RequestList) {
+		return r.Previous.Respond(der)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	responses := make([]ocspSingleResponse, 0, len(req.TBSRequest.RequestList))
+	for _, single := range req.TBSRequest.RequestList {
+		if !r.issued(single.Cert) {
+			return ocspStatus(ocspUnauthorized)
+		}
+		resp := ocspSingleResponse{
+			CertID:     single.Cert,
+			ThisUpdate: now,
+			NextUpdate: now.Add(r.Validity),
+		}
+		rec, err := r.Lookup(single.Cert.SerialNumber)
+		switch {
+		case err != nil:
+			return ocspStatus(ocspInternalError)
+		case rec == nil:
+			resp.Unknown = true
+		case rec.Status == models.StatusRevoked:
+			resp.Revoked = ocspRevokedInfo{
+				RevocationTime: rec.RevokedAt.UTC(),
+				Reason:         asn1.Enumerated(rec.RevocationReason),
+			}
+		default:
+			resp.Good = true
+		}
+		responses = append(responses, resp)
+	}
+
+	var extensions []pkix.Extension
+	for _, ext := range req.TBSRequest.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			extensions = append(extensions, pkix.Extension{Id: oidOCSPNonce, Value: ext.Value})
+		}
+	}
+
+	responder := r.Issuer
+	if r.Certificate != nil {
+		responder = r.Certificate
+	}
+	keyHash, err := publicKeyHash(responder, crypto.SHA1)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	responderID, err := asn1.Marshal(keyHash)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+
+	data := ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:  now,
+		Responses:   responses,
+		Extensions:  extensions,
+	}
+	tbs, err := asn1.Marshal(data)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	algo, signature, err := sign(r.Signer, tbs)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	data.Raw = tbs
+	basic := ocspBasicResponse{
+		TBSResponseData:    data,
+		SignatureAlgorithm: algo,
+		Signature:          signature,
+	}
+	if r.Certificate != nil {
+		basic.Certificates = []asn1.RawValue{{FullBytes: r.Certificate.Raw}}
+	}
+	basicDER, err := asn1.Marshal(basic)
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	out, err := asn1.Marshal(ocspResponse{
+		Status:   ocspSuccessful,
+		Response: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: basicDER},
+	})
+	if err != nil {
+		return ocspStatus(ocspInternalError)
+	}
+	return out
+}
+
+// issued tell if the CertID designate a certificate of our issuer.
+func (r *OCSPResponder) issued(id ocspCertID) bool {
+	hash, ok := ocspHashByOID[id.HashAlgorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		return false
+	}
+	h := hash.New()
+	h.Write(r.Issuer.RawSubject)
+	if !bytes.Equal(h.Sum(nil), id.NameHash) {
+		return false
+	}
+	keyHash, err := publicKeyHash(r.Issuer, hash)
+	return err == nil && bytes.Equal(keyHash, id.IssuerKeyHash)
+}
+
+// issuedAll tell if every request designate a certificate of our issuer.
+func (r *OCSPResponder) issuedAll(list []ocspSingleRequest) bool {
+	for _, single := range list {
+		if !r.issued(single.Cert) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicKeyHash hash the subjectPublicKey bits of cert.
+func publicKeyHash(cert *x509.Certificate, hash crypto.Hash) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+func ocspStatus(status int) []byte {
+	out, _ := asn1.Marshal(ocspResponse{Status: asn1.Enumerated(status)})
+	return out
+}
+
+// OCSPNoCheckExtension is the id-pkix-ocsp-nocheck extension of delegated
+// OCSP signing certificates.
+func OCSPNoCheckExtension() pkix.Extension {
+	return pkix.Extension{Id: oidOCSPNoCheck, Value: asn1.NullBytes}
+}
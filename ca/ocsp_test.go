@@ -0,0 +1,223 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCert issue a certificate of template for a new P-256 key, signed by
+// parent and parentKey, or self-signed when parent is nil.
+func testCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func testCA(t *testing.T, cn string, serial int64) (*x509.Certificate, crypto.Signer) {
+	return testCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+}
+
+func testLeaf(t *testing.T, issuer *x509.Certificate, issuerKey crypto.Signer, serial int64) *x509.Certificate {
+	cert, _ := testCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "node"},
+	}, issuer, issuerKey)
+	return cert
+}
+
+func TestOCSPResponder(t *testing.T) {
+	issuer, issuerKey := testCA(t, "ca", 1)
+	other, otherKey := testCA(t, "other", 2)
+	good := testLeaf(t, issuer, issuerKey, 10)
+	revoked := testLeaf(t, issuer, issuerKey, 11)
+	unknown := testLeaf(t, issuer, issuerKey, 12)
+	foreign := testLeaf(t, other, otherKey, 10)
+	revokedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+	inventory := map[string]*models.Certificate{
+		"10": {Status: models.StatusValid},
+		"11": {Status: models.StatusRevoked, RevokedAt: revokedAt, RevocationReason: ReasonKeyCompromise},
+	}
+	responder := &OCSPResponder{
+		Issuer:   issuer,
+		Signer:   issuerKey,
+		Validity: time.Hour,
+		Lookup: func(serial *big.Int) (*models.Certificate, error) {
+			return inventory[serial.String()], nil
+		},
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		issuer *x509.Certificate
+		hash   crypto.Hash
+		status int
+		reason int
+	}{
+		{name: "good", cert: good, issuer: issuer, status: ocsp.Good},
+		{name: "good sha256", cert: good, issuer: issuer, hash: crypto.SHA256, status: ocsp.Good},
+		{name: "revoked", cert: revoked, issuer: issuer, status: ocsp.Revoked, reason: ocsp.KeyCompromise},
+		{name: "unknown", cert: unknown, issuer: issuer, status: ocsp.Unknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := ocsp.CreateRequest(test.cert, test.issuer, &ocsp.RequestOptions{Hash: test.hash})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := ocsp.ParseResponseForCert(responder.Respond(req), test.cert, test.issuer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != test.status {
+				t.Fatalf("status %d, want %d", resp.Status, test.status)
+			}
+			if resp.SerialNumber.Cmp(test.cert.SerialNumber) != 0 {
+				t.Fatalf("serial %v, want %v", resp.SerialNumber, test.cert.SerialNumber)
+			}
+			if resp.NextUpdate.Sub(resp.ThisUpdate) != time.Hour {
+				t.Fatalf("validity %v, want 1h", resp.NextUpdate.Sub(resp.ThisUpdate))
+			}
+			if test.status == ocsp.Revoked && (resp.RevocationReason != test.reason || !resp.RevokedAt.Equal(revokedAt)) {
+				t.Fatalf("revoked at %v for %d, want %v for %d", resp.RevokedAt, resp.RevocationReason, revokedAt, test.reason)
+			}
+		})
+	}
+
+	errors := []struct {
+		name string
+		req  func() []byte
+		want ocsp.ResponseStatus
+	}{
+		{"malformed", func() []byte { return []byte{0x30, 0x03, 0x01} }, ocsp.Malformed},
+		{"trailing data", func() []byte {
+			req, _ := ocsp.CreateRequest(good, issuer, nil)
+			return append(req, 0)
+		}, ocsp.Malformed},
+		{"unknown issuer", func() []byte {
+			req, _ := ocsp.CreateRequest(foreign, other, nil)
+			return req
+		}, ocsp.Unauthorized},
+	}
+	for _, test := range errors {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ocsp.ParseResponse(responder.Respond(test.req()), nil)
+			rerr, ok := err.(ocsp.ResponseError)
+			if !ok || rerr.Status != test.want {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestOCSPResponderDelegated(t *testing.T) {
+	issuer, issuerKey := testCA(t, "ca", 1)
+	delegate, delegateKey := testCert(t, &x509.Certificate{
+		SerialNumber:    big.NewInt(5),
+		Subject:         pkix.Name{CommonName: "ocsp"},
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtraExtensions: []pkix.Extension{OCSPNoCheckExtension()},
+	}, issuer, issuerKey)
+	leaf := testLeaf(t, issuer, issuerKey, 10)
+	responder := &OCSPResponder{
+		Issuer:      issuer,
+		Signer:      delegateKey,
+		Certificate: delegate,
+		Validity:    time.Hour,
+		Lookup: func(serial *big.Int) (*models.Certificate, error) {
+			return &models.Certificate{Status: models.StatusValid}, nil
+		},
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ocsp.ParseResponseForCert(responder.Respond(req), leaf, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != ocsp.Good || resp.Certificate == nil || !resp.Certificate.Equal(delegate) {
+		t.Fatalf("status %d signed by %v, want good by the delegate", resp.Status, resp.Certificate)
+	}
+}
+
+func TestOCSPResponderPrevious(t *testing.T) {
+	issuer, issuerKey := testCA(t, "new", 1)
+	previous, previousKey := testCA(t, "previous", 2)
+	lookup := func(serial *big.Int) (*models.Certificate, error) {
+		return &models.Certificate{Status: models.StatusValid}, nil
+	}
+	responder := &OCSPResponder{
+		Issuer:   issuer,
+		Signer:   issuerKey,
+		Validity: time.Hour,
+		Lookup:   lookup,
+		Previous: &OCSPResponder{Issuer: previous, Signer: previousKey, Validity: time.Hour, Lookup: lookup},
+	}
+	for _, ca := range []struct {
+		cert *x509.Certificate
+		key  crypto.Signer
+	}{{issuer, issuerKey}, {previous, previousKey}} {
+		leaf := testLeaf(t, ca.cert, ca.key, 10)
+		req, err := ocsp.CreateRequest(leaf, ca.cert, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ParseResponseForCert check the signature with the issuer key.
+		resp, err := ocsp.ParseResponseForCert(responder.Respond(req), leaf, ca.cert)
+		if err != nil {
+			t.Fatalf("%s: %v", ca.cert.Subject.CommonName, err)
+		}
+		if resp.Status != ocsp.Good {
+			t.Fatalf("%s: status %d, want good", ca.cert.Subject.CommonName, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// PolicyError list every reason a request breaks the policy.
+type PolicyError struct {
+	Reasons []string
+}
+
+func (e *PolicyError) Error() string {
+	return "policy: " + strings.Join(e.Reasons, "; ")
+}
+
+// nameMatcher is a compiled NameRule entry.
+type nameMatcher func(name string) bool
+
+// nameRule is a compiled models.NameRule.
+type nameRule struct {
+	allow []nameMatcher
+	deny  []nameMatcher
+}
+
+// newNameRule compile r, with CIDR entries when cidr and case-insensitive
+// regular expressions when fold.
+func newNameRule(r models.NameRule, cidr bool, fold bool) (*nameRule, error) {
+	rule := &nameRule{}
+	for _, list := range []struct {
+		entries  []string
+		matchers *[]nameMatcher
+	}{{r.Allow, &rule.allow}, {r.Deny, &rule.deny}} {
+		for _, entry := range list.entries {
+			m, err := newNameMatcher(entry, cidr, fold)
+			if err != nil {
+				return nil, err
+			}
+			*list.matchers = append(*list.matchers, m)
+		}
+	}
+	return rule, nil
+}
+
+func newNameMatcher(entry string, cidr bool, fold bool) (nameMatcher, error) {
+	if strings.HasPrefix(entry, ".") {
+		suffix := strings.ToLower(entry)
+		return func(name string) bool {
+			return strings.HasSuffix(strings.ToLower(name), suffix)
+		}, nil
+	}
+	if cidr && strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		return func(name string) bool {
+			ip := net.ParseIP(name)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	}
+	expr := "^(?:" + entry + ")$"
+	if fold {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
+
+// configured tell if the rule has any entry.
+func (r *nameRule) configured() bool {
+	return len(r.allow) > 0 || len(r.deny) > 0
+}
+
+// check return why name is refused, an empty string when accepted.
+func (r *nameRule) check(kind string, name string) string {
+	for _, m := range r.deny {
+		if m(name) {
+			return fmt.Sprintf("%s %s is denied", kind, name)
+		}
+	}
+	if len(r.allow) == 0 {
+		return ""
+	}
+	for _, m := range r.allow {
+		if m(name) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s %s is not allowed", kind, name)
+}
+
+// subjectFields give access to the policy subject fields of a name.
+var subjectFields = map[string]func(name *pkix.Name) *[]string{
+	"C":  func(name *pkix.Name) *[]string { return &name.Country },
+	"O":  func(name *pkix.Name) *[]string { return &name.Organization },
+	"OU": func(name *pkix.Name) *[]string { return &name.OrganizationalUnit },
+	"L":  func(name *pkix.Name) *[]string { return &name.Locality },
+	"ST": func(name *pkix.Name) *[]string { return &name.Province },
+}
+
+// Policy is a configured policy ready to check requests.
+type Policy struct {
+	commonName *nameRule
+	dns        *nameRule
+	ip         *nameRule
+	uri        *nameRule
+	email      *nameRule
+	require    []string
+	override   map[string][]string
+}
+
+// NewPolicy check and compile the configured policy.
+func NewPolicy(p models.Policy) (*Policy, error) {
+	policy := &Policy{require: p.Require, override: p.Override}
+	// common names, DNS names and email addresses are compared whatever
+	// their case, URIs keep their case-sensitive path.
+	for _, rule := range []struct {
+		name     string
+		config   models.NameRule
+		compiled **nameRule
+		fold     bool
+	}{
+		{"commonname", p.CommonName, &policy.commonName, true},
+		{"dns", p.DNS, &policy.dns, true},
+		{"ip", p.IP, &policy.ip, false},
+		{"uri", p.URI, &policy.uri, false},
+		{"email", p.Email, &policy.email, true},
+	} {
+		var err error
+		if *rule.compiled, err = newNameRule(rule.config, rule.name == "ip", rule.fold); err != nil {
+			return nil, fmt.Errorf("policy %s: %v", rule.name, err)
+		}
+	}
+	for _, field := range p.Require {
+		if _, ok := subjectFields[field]; !ok {
+			return nil, fmt.Errorf("policy require: unknown subject field %q", field)
+		}
+	}
+	for field := range p.Override {
+		if _, ok := subjectFields[field]; !ok {
+			return nil, fmt.Errorf("policy override: unknown subject field %q", field)
+		}
+	}
+	return policy, nil
+}
+
+// Apply check the subject and names of template, and the email and URI
+// names of csr, then force the overridden subject fields. Email and URI
+// names are only issued when their rule is configured. A nil policy
+// accepts everything.
+func (p *Policy) Apply(template *x509.Certificate, csr *x509.CertificateRequest) error {
+	if p == nil {
+		return nil
+	}
+	var reasons []string
+	add := func(reason string) {
+		if reason != "" {
+			reasons = append(reasons, reason)
+		}
+	}
+	add(p.commonName.check("common name", template.Subject.CommonName))
+	for _, name := range template.DNSNames {
+		add(p.dns.check("DNS name", name))
+	}
+	for _, ip := range template.IPAddresses {
+		add(p.ip.check("IP address", ip.String()))
+	}
+	if p.email.configured() {
+		for _, email := range csr.EmailAddresses {
+			add(p.email.check("email address", email))
+		}
+		template.EmailAddresses = csr.EmailAddresses
+	}
+	if p.uri.configured() {
+		for _, uri := range csr.URIs {
+			add(p.uri.check("URI", uri.String()))
+		}
+		template.URIs = csr.URIs
+	}
+	for _, field := range p.require {
+		if len(*subjectFields[field](&template.Subject)) == 0 {
+			add(fmt.Sprintf("subject field %s is required", field))
+		}
+	}
+	if len(reasons) > 0 {
+		return &PolicyError{Reasons: reasons}
+	}
+	if len(p.override) > 0 {
+		for field, values := range p.override {
+			*subjectFields[field](&template.Subject) = values
+		}
+		template.RawSubject = nil
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+func TestNameMatcher(t *testing.T) {
+	tests := []struct {
+		entry string
+		cidr  bool
+		fold  bool
+		name  string
+		want  bool
+	}{
+		{entry: "EZB_PKI", fold: true, name: "ezb_pki", want: true},
+		{entry: "ezb_pki", fold: true, name: "EZB_PKI", want: true},
+		{entry: "EZB_PKI", name: "ezb_pki", want: false},
+		{entry: "node", fold: true, name: "node2", want: false},
+		{entry: "node", fold: true, name: "mynode", want: false},
+		{entry: "node|proxy", fold: true, name: "proxy", want: true},
+		{entry: `web\d+\.corp\.local`, fold: true, name: "WEB12.corp.local", want: true},
+		{entry: `web\d+\.corp\.local`, fold: true, name: "web12xcorp.local", want: false},
+		{entry: ".corp.local", name: "a.CORP.Local", want: true},
+		{entry: ".Corp.Local", name: "a.b.corp.local", want: true},
+		{entry: ".corp.local", name: "corp.local", want: false},
+		{entry: ".corp.local", name: "evilcorp.local", want: false},
+		{entry: ".corp.local", name: "a.corp.local.evil", want: false},
+		{entry: "10.0.0.0/8", cidr: true, name: "10.1.2.3", want: true},
+		{entry: "10.0.0.0/8", cidr: true, name: "11.0.0.1", want: false},
+		{entry: "fd00::/8", cidr: true, name: "fd00::1", want: true},
+		{entry: "fd00::/8", cidr: true, name: "10.0.0.1", want: false},
+		{entry: "10.0.0.1", cidr: true, name: "10.0.0.1", want: true},
+	}
+	for _, test := range tests {
+		m, err := newNameMatcher(test.entry, test.cidr, test.fold)
+		if err != nil {
+			t.Fatalf("%s: %v", test.entry, err)
+		}
+		if got := m(test.name); got != test.want {
+			t.Errorf("%s (fold %v) against %s: got %v, want %v", test.entry, test.fold, test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewPolicyErrors(t *testing.T) {
+	for name, config := range map[string]models.Policy{
+		"regexp":   {DNS: models.NameRule{Allow: []string{"web[0-9"}}},
+		"cidr":     {IP: models.NameRule{Deny: []string{"10.0.0.0/33"}}},
+		"require":  {Require: []string{"CN"}},
+		"override": {Override: map[string][]string{"SERIALNUMBER": {"1"}}},
+	} {
+		if _, err := NewPolicy(config); err == nil {
+			t.Errorf("%s: invalid policy accepted", name)
+		}
+	}
+}
+
+func TestPolicyApply(t *testing.T) {
+	policy, err := NewPolicy(models.Policy{
+		CommonName: models.NameRule{Deny: []string{"EZB_PKI", "admin.*"}},
+		DNS:        models.NameRule{Allow: []string{".corp.local"}, Deny: []string{`admin\..*`}},
+		IP:         models.NameRule{Allow: []string{"10.0.0.0/8"}},
+		Email:      models.NameRule{Allow: []string{`[a-z]+@CORP\.LOCAL`}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spiffe, _ := url.Parse("spiffe://corp.local/node")
+	tests := []struct {
+		name     string
+		template x509.Certificate
+		csr      x509.CertificateRequest
+		reasons  []string
+	}{
+		{
+			name:     "accepted",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "node"}, DNSNames: []string{"node.corp.local"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.5")}},
+		},
+		{
+			name:     "denied whatever the case",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "ezb_pki"}},
+			reasons:  []string{"common name ezb_pki is denied"},
+		},
+		{
+			name:     "deny before allow",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "node"}, DNSNames: []string{"admin.corp.local"}},
+			reasons:  []string{"DNS name admin.corp.local is denied"},
+		},
+		{
+			name:     "not allowed",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "node"}, DNSNames: []string{"node.other"}, IPAddresses: []net.IP{net.ParseIP("192.168.0.1")}},
+			reasons:  []string{"DNS name node.other is not allowed", "IP address 192.168.0.1 is not allowed"},
+		},
+		{
+			name:     "email allowed whatever the case",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "node"}},
+			csr:      x509.CertificateRequest{EmailAddresses: []string{"Ops@corp.local"}},
+		},
+		{
+			name:     "email not allowed",
+			template: x509.Certificate{Subject: pkix.Name{CommonName: "node"}},
+			csr:      x509.CertificateRequest{EmailAddresses: []string{"ops@other"}},
+			reasons:  []string{"email address ops@other is not allowed"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.csr.URIs = []*url.URL{spiffe}
+			err := policy.Apply(&test.template, &test.csr)
+			if len(test.reasons) == 0 {
+				if err != nil {
+					t.Fatalf("refused: %v", err)
+				}
+				if len(test.template.URIs) != 0 {
+					t.Fatal("URI issued without uri rule")
+				}
+				if len(test.template.EmailAddresses) != len(test.csr.EmailAddresses) {
+					t.Fatal("email addresses not issued")
+				}
+				return
+			}
+			perr, ok := err.(*PolicyError)
+			if !ok {
+				t.Fatalf("got %v, want a policy error", err)
+			}
+			if strings.Join(perr.Reasons, "; ") != strings.Join(test.reasons, "; ") {
+				t.Fatalf("reasons %q, want %q", perr.Reasons, test.reasons)
+			}
+		})
+	}
+}
+
+func TestPolicyOverride(t *testing.T) {
+	policy, err := NewPolicy(models.Policy{
+		Require:  []string{"OU"},
+		Override: map[string][]string{"O": {"ezBastion"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "node", Organization: []string{"Evil"}, OrganizationalUnit: []string{"ops"}}
+	raw, err := asn1.Marshal(subject.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{Subject: subject, RawSubject: raw}
+	if err = policy.Apply(template, &x509.CertificateRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if template.RawSubject != nil {
+		t.Fatal("RawSubject kept, the override would be ignored")
+	}
+	if len(template.Subject.Organization) != 1 || template.Subject.Organization[0] != "ezBastion" {
+		t.Fatalf("organization %v, want ezBastion", template.Subject.Organization)
+	}
+
+	refused := &x509.Certificate{Subject: pkix.Name{CommonName: "node", Organization: []string{"Evil"}}, RawSubject: raw}
+	err = policy.Apply(refused, &x509.CertificateRequest{})
+	if perr, ok := err.(*PolicyError); !ok || perr.Reasons[0] != "subject field OU is required" {
+		t.Fatalf("got %v, want subject field OU is required", err)
+	}
+	if refused.RawSubject == nil || refused.Subject.Organization[0] != "Evil" {
+		t.Fatal("refused template overridden")
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	var policy *Policy
+	if err := policy.Apply(&x509.Certificate{}, &x509.CertificateRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
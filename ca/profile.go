@@ -0,0 +1,252 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// oidCertificateTemplateName is the Microsoft certificate template name
+// extension (szOID_ENROLL_CERTTYPE_EXTENSION), used by requests to select
+// a profile like with AD CS.
+var oidCertificateTemplateName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2}
+
+// oidNoRevAvail is the RFC 9608 extension telling that no revocation
+// information is available for the certificate.
+var oidNoRevAvail = asn1.ObjectIdentifier{2, 5, 29, 56}
+
+// MaxShortLived is the longest validity of a short-lived profile, and
+// DefaultBackdate their NotBefore skew when not configured.
+const (
+	MaxShortLived   = 7 * 24 * time.Hour
+	DefaultBackdate = 5 * time.Minute
+)
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"certSign":          x509.KeyUsageCertSign,
+	"crlSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"ocspSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// ParseValidity accept a Go duration or a number of days such as 365d.
+func ParseValidity(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid validity %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid validity %q", s)
+	}
+	return d, nil
+}
+
+// RequestedProfile return the profile name carried by the certificate
+// template name extension of csr, an empty string if absent.
+func RequestedProfile(csr *x509.CertificateRequest) (string, error) {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidCertificateTemplateName) {
+			continue
+		}
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &raw); err != nil {
+			return "", err
+		}
+		if raw.Class == asn1.ClassUniversal && raw.Tag == 30 {
+			// BMPString, as written by Windows.
+			if len(raw.Bytes)%2 != 0 {
+				return "", fmt.Errorf("invalid template name")
+			}
+			u := make([]uint16, len(raw.Bytes)/2)
+			for i := range u {
+				u[i] = uint16(raw.Bytes[2*i])<<8 | uint16(raw.Bytes[2*i+1])
+			}
+			return string(utf16.Decode(u)), nil
+		}
+		var name string
+		if _, err := asn1.Unmarshal(ext.Value, &name); err != nil {
+			return "", err
+		}
+		return name, nil
+	}
+	return "", nil
+}
+
+// TemplateNameExtension return the extension selecting profile in a
+// certificate request.
+func TemplateNameExtension(profile string) (pkix.Extension, error) {
+	value, err := asn1.MarshalWithParams(profile, "utf8")
+	return pkix.Extension{Id: oidCertificateTemplateName, Value: value}, err
+}
+
+// Profile is a configured profile ready to issue certificates.
+type Profile struct {
+	Name         string
+	Validity     time.Duration
+	KeyUsage     x509.KeyUsage
+	ExtKeyUsage  []x509.ExtKeyUsage
+	AllowedNames []*regexp.Regexp
+	Extensions   []pkix.Extension
+	ShortLived   bool
+	Backdate     time.Duration
+}
+
+// NewProfile check and compile a configured profile.
+func NewProfile(name string, p models.Profile) (*Profile, error) {
+	profile := &Profile{Name: name}
+	var err error
+	if profile.Validity, err = ParseValidity(p.Validity); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", name, err)
+	}
+	for _, s := range p.KeyUsage {
+		ku, ok := keyUsages[s]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown key usage %q", name, s)
+		}
+		profile.KeyUsage |= ku
+	}
+	for _, s := range p.ExtKeyUsage {
+		eku, ok := extKeyUsages[s]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown extended key usage %q", name, s)
+		}
+		profile.ExtKeyUsage = append(profile.ExtKeyUsage, eku)
+	}
+	for _, s := range p.AllowedNames {
+		re, err := regexp.Compile("^(?:" + s + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		profile.AllowedNames = append(profile.AllowedNames, re)
+	}
+	for _, e := range p.Extensions {
+		ext, err := parseExtension(e)
+		if err != nil {
+			return nil, fmt.Errorf("profile %s: %v", name, err)
+		}
+		profile.Extensions = append(profile.Extensions, ext)
+	}
+	if p.Backdate != "" {
+		if profile.Backdate, err = time.ParseDuration(p.Backdate); err != nil || profile.Backdate < 0 {
+			return nil, fmt.Errorf("profile %s: invalid backdate %q", name, p.Backdate)
+		}
+	}
+	if p.ShortLived {
+		if profile.Validity > MaxShortLived {
+			return nil, fmt.Errorf("profile %s: short-lived validity %s exceed %s", name, profile.Validity, MaxShortLived)
+		}
+		if p.Backdate == "" {
+			profile.Backdate = DefaultBackdate
+		}
+		profile.ShortLived = true
+		profile.Extensions = append(profile.Extensions, pkix.Extension{Id: oidNoRevAvail, Value: asn1.NullBytes})
+	}
+	return profile, nil
+}
+
+func parseExtension(e models.Extension) (pkix.Extension, error) {
+	var ext pkix.Extension
+	for _, part := range strings.Split(e.OID, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return ext, fmt.Errorf("invalid extension oid %q", e.OID)
+		}
+		ext.Id = append(ext.Id, n)
+	}
+	if len(ext.Id) < 2 {
+		return ext, fmt.Errorf("invalid extension oid %q", e.OID)
+	}
+	value, err := base64.StdEncoding.DecodeString(e.Value)
+	if err != nil {
+		return ext, fmt.Errorf("extension %s: %v", e.OID, err)
+	}
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(value, &raw); err != nil || len(rest) > 0 {
+		return ext, fmt.Errorf("extension %s: value is not DER", e.OID)
+	}
+	ext.Critical = e.Critical
+	ext.Value = value
+	return ext, nil
+}
+
+// Template build the certificate template for csr, refusing subject
+// alternative names the profile does not allow. NotBefore is backdated,
+// the validity runs from now.
+func (p *Profile) Template(csr *x509.CertificateRequest, now time.Time) (*x509.Certificate, error) {
+	for _, name := range csr.DNSNames {
+		if !p.allows(name) {
+			return nil, fmt.Errorf("profile %s does not allow DNS name %s", p.Name, name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if !p.allows(ip.String()) {
+			return nil, fmt.Errorf("profile %s does not allow IP address %s", p.Name, ip)
+		}
+	}
+	return &x509.Certificate{
+		Subject:               csr.Subject,
+		NotBefore:             now.Add(-p.Backdate),
+		NotAfter:              now.Add(p.Validity),
+		KeyUsage:              p.KeyUsage,
+		ExtKeyUsage:           p.ExtKeyUsage,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		ExtraExtensions:       p.Extensions,
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+func (p *Profile) allows(name string) bool {
+	if len(p.AllowedNames) == 0 {
+		return true
+	}
+	for _, re := range p.AllowedNames {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// serialRandomBits is the CSPRNG output in each serial, below the counter.
+const serialRandomBits = 64
+
+// SerialAllocator hands out certificate serial numbers from a monotonic
+// counter persisted on disk, so serials stay unique across restarts, the
+// service and the command line. Each serial is the counter followed by 64
+// random bits, so serials are not predictable.
+type SerialAllocator struct {
+	mu   sync.Mutex
+	file string
+}
+
+// NewSerialAllocator returns an allocator backed by file. The file is created
+// on first use with a random 64 bits starting value.
+func NewSerialAllocator(file string) *SerialAllocator {
+	return &SerialAllocator{file: file}
+}
+
+// Next returns a serial number never returned before by this allocator.
+// The counter is written back to disk before the serial is handed out,
+// under a lock of <file>.lock held against the other processes.
+func (s *SerialAllocator) Next() (*big.Int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := os.OpenFile(s.file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		return nil, fmt.Errorf("%s: %v", lock.Name(), err)
+	}
+	defer unlockFile(lock)
+
+	current, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	next := new(big.Int).Add(current, big.NewInt(1))
+	if err := s.write(next); err != nil {
+		return nil, err
+	}
+	random, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), serialRandomBits))
+	if err != nil {
+		return nil, err
+	}
+	return next.Lsh(next, serialRandomBits).Or(next, random), nil
+}
+
+func (s *SerialAllocator) read() (*big.Int, error) {
+	raw, err := ioutil.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		// start far away from the legacy hard coded serials (1653 and 2)
+		// and keep the first value unpredictable.
+		seed, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+		if err != nil {
+			return nil, err
+		}
+		return seed.Add(seed, big.NewInt(1<<16)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	current, ok := new(big.Int).SetString(strings.TrimSpace(string(raw)), 16)
+	if !ok || current.Sign() < 0 {
+		return nil, fmt.Errorf("%s: invalid serial counter", s.file)
+	}
+	return current, nil
+}
+
+// write replace the counter file through a temporary file of its own.
+func (s *SerialAllocator) write(serial *big.Int) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(tmp, "%X\n", serial)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempSerialFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "ca.srl"), func() { os.RemoveAll(dir) }
+}
+
+// counterOf return the counter part of a serial, see SerialAllocator.Next.
+func counterOf(serial *big.Int) *big.Int {
+	return new(big.Int).Rsh(serial, serialRandomBits)
+}
+
+func TestSerialUnique(t *testing.T) {
+	file, cleanup := tempSerialFile(t)
+	defer cleanup()
+
+	// two allocators on the same file stand for the service and the cli
+	allocators := []*SerialAllocator{NewSerialAllocator(file), NewSerialAllocator(file)}
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(s *SerialAllocator) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				serial, err := s.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				for _, key := range []string{"serial " + serial.String(), "counter " + counterOf(serial).String()} {
+					if seen[key] {
+						t.Errorf("duplicate %s", key)
+					}
+					seen[key] = true
+				}
+				mu.Unlock()
+			}
+		}(allocators[i%2])
+	}
+	wg.Wait()
+	if len(seen) != 2*8*25 {
+		t.Errorf("got %d distinct values, want %d", len(seen), 2*8*25)
+	}
+}
+
+func TestSerialReopen(t *testing.T) {
+	file, cleanup := tempSerialFile(t)
+	defer cleanup()
+
+	first, err := NewSerialAllocator(file).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Sign() <= 0 || counterOf(first).Cmp(big.NewInt(1<<16)) <= 0 {
+		t.Errorf("first serial %X starts too low", first)
+	}
+	next, err := NewSerialAllocator(file).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Add(counterOf(first), big.NewInt(1))
+	if counterOf(next).Cmp(want) != 0 {
+		t.Errorf("reopened counter is %X, want %X", counterOf(next), want)
+	}
+}
+
+func TestSerialInvalidCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"not hex", "12G4\n"},
+		{"negative", "-1F\n"},
+		{"garbage", "\x00\x01\x02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, cleanup := tempSerialFile(t)
+			defer cleanup()
+			if err := ioutil.WriteFile(file, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if serial, err := NewSerialAllocator(file).Next(); err == nil {
+				t.Fatalf("got serial %X, want an error", serial)
+			}
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != tt.content {
+				t.Errorf("counter file rewritten to %q", raw)
+			}
+		})
+	}
+}
+
+func TestSerialLocked(t *testing.T) {
+	file, cleanup := tempSerialFile(t)
+	defer cleanup()
+
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if err := lockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewSerialAllocator(file).Next()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Next returned %v while the counter was locked", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("counter file written while locked: %v", err)
+	}
+
+	if err := unlockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next still blocked after the lock was released")
+	}
+}
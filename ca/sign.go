@@ -0,0 +1,88 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+var (
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidSignatureSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSignatureSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidSignatureEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// SignatureAlgorithm return the signature algorithm matching the CA
+// public key, its ASN.1 identifier and the digest to apply before signing.
+func SignatureAlgorithm(pub crypto.PublicKey) (x509.SignatureAlgorithm, pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, crypto.SHA256, nil
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA384}, crypto.SHA384, nil
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512, pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA512}, crypto.SHA512, nil
+		}
+		return 0, pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported elliptic curve %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		null := asn1.RawValue{Tag: asn1.TagNull}
+		switch {
+		case pub.N.BitLen() >= 4096:
+			return x509.SHA512WithRSA, pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA512WithRSA, Parameters: null}, crypto.SHA512, nil
+		case pub.N.BitLen() >= 3072:
+			return x509.SHA384WithRSA, pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA384WithRSA, Parameters: null}, crypto.SHA384, nil
+		}
+		return x509.SHA256WithRSA, pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256WithRSA, Parameters: null}, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, pkix.AlgorithmIdentifier{Algorithm: oidSignatureEd25519}, 0, nil
+	}
+	return 0, pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// sign the DER encoded tbs structure with key and return the algorithm
+// identifier and the signature bits to append to it.
+func sign(key crypto.Signer, tbs []byte) (pkix.AlgorithmIdentifier, asn1.BitString, error) {
+	_, algo, hash, err := SignatureAlgorithm(key.Public())
+	if err != nil {
+		return algo, asn1.BitString{}, err
+	}
+	digest := tbs
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbs)
+		digest = h.Sum(nil)
+	}
+	signature, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return algo, asn1.BitString{}, err
+	}
+	return algo, asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)}, nil
+}
@@ -0,0 +1,292 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package client request certificates from an ezb_pki daemon with the
+// version 1 protocol of the signing port.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/protocol"
+)
+
+// ErrRootMismatch is returned when the CA does not match the pinned
+// fingerprint.
+var ErrRootMismatch = errors.New("root certificate does not match the pinned fingerprint")
+
+// PendingError is returned while the request waits for an operator
+// approval, poll with its ID.
+type PendingError struct {
+	ID string
+}
+
+func (e *PendingError) Error() string {
+	return "request " + e.ID + " pending approval"
+}
+
+// Client talk to the signing port at Addr.
+type Client struct {
+	Addr string
+	// Timeout bound each attempt, 30 seconds when zero.
+	Timeout time.Duration
+	// Retries is the number of extra attempts after a network or internal
+	// server error, RetryDelay the wait between them (5 seconds when zero).
+	Retries    int
+	RetryDelay time.Duration
+	// RootFingerprint is the hex SHA-256 of the root certificate, colons
+	// allowed. When set the returned chain, and the TLS server chain,
+	// must end with this root.
+	RootFingerprint string
+	// TLSConfig enable TLS, with a client certificate to renew it.
+	TLSConfig *tls.Config
+	// Profile and Token are sent with the request when set.
+	Profile string
+	Token   string
+}
+
+// RequestCertificate send the DER encoded csr to addr and return the
+// issued certificate and the root.
+func RequestCertificate(ctx context.Context, addr string, csr []byte) (*x509.Certificate, *x509.Certificate, error) {
+	return (&Client{Addr: addr}).RequestCertificate(ctx, csr)
+}
+
+// RequestCertificate send the DER encoded csr and return the issued
+// certificate and the root, verified against each other.
+func (c *Client) RequestCertificate(ctx context.Context, csr []byte) (*x509.Certificate, *x509.Certificate, error) {
+	return c.do(ctx, &protocol.Request{
+		Type:    protocol.TypeSign,
+		CSR:     csr,
+		Profile: c.Profile,
+		Token:   c.Token,
+	})
+}
+
+// Renew send the DER encoded csr to replace the client certificate of
+// TLSConfig. The new certificate keeps its subject and names, the csr
+// key may be new.
+func (c *Client) Renew(ctx context.Context, csr []byte) (*x509.Certificate, *x509.Certificate, error) {
+	if c.TLSConfig == nil || len(c.TLSConfig.Certificates) == 0 && c.TLSConfig.GetClientCertificate == nil {
+		return nil, nil, errors.New("renewal needs the current certificate in TLSConfig")
+	}
+	return c.do(ctx, &protocol.Request{Type: protocol.TypeRenew, CSR: csr})
+}
+
+// Poll ask for the certificate of a request queued for approval.
+func (c *Client) Poll(ctx context.Context, id string) (*x509.Certificate, *x509.Certificate, error) {
+	return c.do(ctx, &protocol.Request{Type: protocol.TypePoll, ID: id})
+}
+
+func (c *Client) do(ctx context.Context, req *protocol.Request) (*x509.Certificate, *x509.Certificate, error) {
+	delay := c.RetryDelay
+	if delay == 0 {
+		delay = 5 * time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		leaf, root, err := c.exchange(ctx, req)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			return leaf, root, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func retryable(err error) bool {
+	switch err := err.(type) {
+	case *protocol.Error:
+		return err.Code == protocol.CodeInternal
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+func (c *Client) exchange(ctx context.Context, req *protocol.Request) (*x509.Certificate, *x509.Certificate, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.TLSConfig != nil {
+		tlsConn := tls.Client(conn, c.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	writer := bufio.NewWriter(conn)
+	if err := protocol.WriteFrame(writer, req); err != nil {
+		return nil, nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+	var resp protocol.Response
+	if err := protocol.ReadFrame(bufio.NewReader(conn), &resp); err != nil {
+		return nil, nil, err
+	}
+
+	switch resp.Status {
+	case protocol.StatusIssued:
+		return c.verify(&resp)
+	case protocol.StatusPending:
+		return nil, nil, &PendingError{ID: resp.ID}
+	case protocol.StatusError:
+		if resp.Error != nil {
+			return nil, nil, resp.Error
+		}
+	}
+	return nil, nil, fmt.Errorf("unexpected response status %q", resp.Status)
+}
+
+// tlsConfig verify the server chain against the pinned root instead of
+// the system roots when a fingerprint is set.
+func (c *Client) tlsConfig() *tls.Config {
+	config := c.TLSConfig.Clone()
+	if c.RootFingerprint == "" || config.RootCAs != nil {
+		return config
+	}
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) < 2 {
+			return errors.New("server did not send its chain")
+		}
+		_, err := c.verifyChain(certs[0], certs[1:], x509.ExtKeyUsageServerAuth)
+		return err
+	}
+	return config
+}
+
+// verify parse the issued certificate and check it chains to the root.
+func (c *Client) verify(resp *protocol.Response) (*x509.Certificate, *x509.Certificate, error) {
+	leaf, err := x509.ParseCertificate(resp.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Chain) == 0 {
+		return nil, nil, errors.New("empty certificate chain")
+	}
+	chain := make([]*x509.Certificate, 0, len(resp.Chain))
+	for _, raw := range resp.Chain {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, cert)
+	}
+	root, err := c.verifyChain(leaf, chain, x509.ExtKeyUsageAny)
+	if err != nil {
+		return nil, nil, err
+	}
+	return leaf, root, nil
+}
+
+// verifyChain check leaf against chain, whose last certificate is the
+// root, and the root against the pinned fingerprint.
+func (c *Client) verifyChain(leaf *x509.Certificate, chain []*x509.Certificate, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	root := chain[len(chain)-1]
+	if c.RootFingerprint != "" {
+		pin, err := hex.DecodeString(strings.Replace(c.RootFingerprint, ":", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid root fingerprint: %v", err)
+		}
+		fp := sha256.Sum256(root.Raw)
+		if !bytes.Equal(fp[:], pin) {
+			return nil, ErrRootMismatch
+		}
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[:len(chain)-1] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// NewKeyAndCSR generate a P-256 key and the DER encoded CSR of a node.
+// names are added as IP addresses when they parse as such, DNS names
+// otherwise.
+func NewKeyAndCSR(commonName string, names ...string) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   commonName,
+		},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, csr, nil
+}
@@ -0,0 +1,411 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/protocol"
+)
+
+// testCA is a root signing the server and the issued certificates.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue sign a certificate of subject for pub, valid for validity.
+func (ca *testCA) issue(t *testing.T, subject pkix.Name, pub interface{}, validity time.Duration, usage x509.ExtKeyUsage) *x509.Certificate {
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// sign answer a sign or renew request with a certificate for its CSR.
+func (ca *testCA) sign(t *testing.T, req *protocol.Request) *protocol.Response {
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeBadCSR, "%v", err)}
+	}
+	cert := ca.issue(t, csr.Subject, csr.PublicKey, time.Hour, x509.ExtKeyUsageClientAuth)
+	return &protocol.Response{Status: protocol.StatusIssued, Certificate: cert.Raw, Chain: [][]byte{ca.cert.Raw}}
+}
+
+// tlsConfig return the server side configuration, the chain ends with the
+// root as the service sends it.
+func (ca *testCA) tlsConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := ca.issue(t, pkix.Name{CommonName: "pki"}, key.Public(), time.Hour, x509.ExtKeyUsageServerAuth)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw, ca.cert.Raw}, PrivateKey: key}},
+	}
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	fp := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(fp[:])
+}
+
+// testServer speak the version 1 protocol on a local port, answering each
+// request with handle. requests record the requests received.
+type testServer struct {
+	listener net.Listener
+	handle   func(req *protocol.Request, state *tls.ConnectionState) *protocol.Response
+
+	mu       sync.Mutex
+	requests []protocol.Request
+}
+
+func newTestServer(t *testing.T, config *tls.Config, handle func(req *protocol.Request, state *tls.ConnectionState) *protocol.Response) *testServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	s := &testServer{listener: listener, handle: handle}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) Close() {
+	s.listener.Close()
+}
+
+func (s *testServer) Requests() []protocol.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]protocol.Request(nil), s.requests...)
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var state *tls.ConnectionState
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				cs := tlsConn.ConnectionState()
+				state = &cs
+			}
+			var req protocol.Request
+			if err := protocol.ReadFrame(bufio.NewReader(conn), &req); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.requests = append(s.requests, req)
+			s.mu.Unlock()
+			protocol.WriteFrame(conn, s.handle(&req, state))
+		}(conn)
+	}
+}
+
+func newCSR(t *testing.T, cn string) []byte {
+	_, csr, err := NewKeyAndCSR(cn, "node.domain", "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestRequestCertificate(t *testing.T) {
+	ca := newTestCA(t, "root")
+	srv := newTestServer(t, nil, func(req *protocol.Request, _ *tls.ConnectionState) *protocol.Response {
+		return ca.sign(t, req)
+	})
+	defer srv.Close()
+
+	c := &Client{Addr: srv.Addr(), Profile: "server", Token: "secret", RootFingerprint: fingerprint(ca.cert)}
+	leaf, root, err := c.RequestCertificate(context.Background(), newCSR(t, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "node" || !root.Equal(ca.cert) {
+		t.Errorf("got %s issued by %s", leaf.Subject, root.Subject)
+	}
+	req := srv.Requests()[0]
+	if req.Type != protocol.TypeSign || req.Profile != "server" || req.Token != "secret" {
+		t.Errorf("server received %+v", req)
+	}
+}
+
+func TestRootMismatch(t *testing.T) {
+	ca := newTestCA(t, "root")
+	other := newTestCA(t, "other root")
+	handle := func(req *protocol.Request, _ *tls.ConnectionState) *protocol.Response {
+		return ca.sign(t, req)
+	}
+
+	t.Run("tls", func(t *testing.T) {
+		srv := newTestServer(t, ca.tlsConfig(t), handle)
+		defer srv.Close()
+
+		c := &Client{Addr: srv.Addr(), TLSConfig: &tls.Config{}, Token: "secret", RootFingerprint: fingerprint(other.cert)}
+		_, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node"))
+		if err == nil || !strings.Contains(err.Error(), ErrRootMismatch.Error()) {
+			t.Fatalf("got %v, want %v", err, ErrRootMismatch)
+		}
+		if n := len(srv.Requests()); n != 0 {
+			t.Errorf("the token was sent to an unpinned server in %d requests", n)
+		}
+
+		c.RootFingerprint = strings.ToUpper(fingerprint(ca.cert))
+		if _, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node")); err != nil {
+			t.Errorf("pinned root refused: %v", err)
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		srv := newTestServer(t, nil, handle)
+		defer srv.Close()
+
+		c := &Client{Addr: srv.Addr(), RootFingerprint: fingerprint(other.cert)}
+		if _, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node")); err != ErrRootMismatch {
+			t.Errorf("got %v, want %v", err, ErrRootMismatch)
+		}
+	})
+
+	t.Run("forged chain", func(t *testing.T) {
+		// the pinned root sent with a leaf it did not sign
+		srv := newTestServer(t, nil, func(req *protocol.Request, state *tls.ConnectionState) *protocol.Response {
+			resp := other.sign(t, req)
+			resp.Chain = [][]byte{ca.cert.Raw}
+			return resp
+		})
+		defer srv.Close()
+
+		c := &Client{Addr: srv.Addr(), RootFingerprint: fingerprint(ca.cert)}
+		if _, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node")); err == nil {
+			t.Error("leaf of another CA accepted")
+		}
+	})
+}
+
+func TestRetry(t *testing.T) {
+	ca := newTestCA(t, "root")
+	tests := []struct {
+		name     string
+		failures int
+		code     string
+		retries  int
+		attempts int
+		wantErr  string
+	}{
+		{"success after internal errors", 2, protocol.CodeInternal, 2, 3, ""},
+		{"retries exhausted", 5, protocol.CodeInternal, 1, 2, protocol.CodeInternal},
+		{"refusal not retried", 5, protocol.CodeRefused, 3, 1, protocol.CodeRefused},
+		{"no retry", 1, protocol.CodeInternal, 0, 1, protocol.CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var times []time.Time
+			srv := newTestServer(t, nil, func(req *protocol.Request, _ *tls.ConnectionState) *protocol.Response {
+				mu.Lock()
+				defer mu.Unlock()
+				times = append(times, time.Now())
+				if len(times) <= tt.failures {
+					return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(tt.code, "attempt %d", len(times))}
+				}
+				return ca.sign(t, req)
+			})
+			defer srv.Close()
+
+			delay := 50 * time.Millisecond
+			c := &Client{Addr: srv.Addr(), Retries: tt.retries, RetryDelay: delay}
+			_, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node"))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "":
+				if perr, ok := err.(*protocol.Error); !ok || perr.Code != tt.wantErr {
+					t.Fatalf("got %v, want code %s", err, tt.wantErr)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(times) != tt.attempts {
+				t.Fatalf("%d attempts, want %d", len(times), tt.attempts)
+			}
+			for i := 1; i < len(times); i++ {
+				if wait := times[i].Sub(times[i-1]); wait < delay {
+					t.Errorf("attempt %d after %v, want at least %v", i+1, wait, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryNetworkError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	delay := 50 * time.Millisecond
+	c := &Client{Addr: addr, Retries: 2, RetryDelay: delay}
+	start := time.Now()
+	_, _, err = c.RequestCertificate(context.Background(), newCSR(t, "node"))
+	if _, ok := err.(net.Error); !ok {
+		t.Fatalf("got %v, want a network error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("gave up after %v, want 2 retries %v apart", elapsed, delay)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	srv := newTestServer(t, nil, func(req *protocol.Request, _ *tls.ConnectionState) *protocol.Response {
+		return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeInternal, "down")}
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c := &Client{Addr: srv.Addr(), Retries: 10, RetryDelay: time.Hour}
+	start := time.Now()
+	if _, _, err := c.RequestCertificate(ctx, newCSR(t, "node")); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("backoff not interrupted, returned after %v", elapsed)
+	}
+}
+
+func TestPending(t *testing.T) {
+	ca := newTestCA(t, "root")
+	var mu sync.Mutex
+	var csr []byte
+	polls := 0
+	srv := newTestServer(t, nil, func(req *protocol.Request, _ *tls.ConnectionState) *protocol.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Type {
+		case protocol.TypeSign:
+			csr = req.CSR
+			return &protocol.Response{Status: protocol.StatusPending, ID: "42"}
+		case protocol.TypePoll:
+			if req.ID != "42" {
+				return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeNotFound, "request %s not found", req.ID)}
+			}
+			if polls++; polls < 3 {
+				return &protocol.Response{Status: protocol.StatusPending, ID: "42"}
+			}
+			return ca.sign(t, &protocol.Request{CSR: csr})
+		}
+		return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeMalformed, "type %s", req.Type)}
+	})
+	defer srv.Close()
+
+	c := &Client{Addr: srv.Addr(), RootFingerprint: fingerprint(ca.cert)}
+	_, _, err := c.RequestCertificate(context.Background(), newCSR(t, "node"))
+	var pending *PendingError
+	if !errors.As(err, &pending) || pending.ID != "42" {
+		t.Fatalf("got %v, want a pending error", err)
+	}
+
+	var leaf *x509.Certificate
+	for i := 0; i < 5 && leaf == nil; i++ {
+		leaf, _, err = c.Poll(context.Background(), pending.ID)
+		if err != nil && !errors.As(err, &pending) {
+			t.Fatal(err)
+		}
+	}
+	if leaf == nil || leaf.Subject.CommonName != "node" {
+		t.Fatalf("got %v after polling, want the certificate", err)
+	}
+	if polls != 3 {
+		t.Errorf("issued after %d polls, want 3", polls)
+	}
+
+	_, _, err = c.Poll(context.Background(), "43")
+	if perr, ok := err.(*protocol.Error); !ok || perr.Code != protocol.CodeNotFound {
+		t.Errorf("got %v, want code %s", err, protocol.CodeNotFound)
+	}
+}
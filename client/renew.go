@@ -0,0 +1,190 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrExpired is returned by Run when the certificate expired before it
+// could be renewed, a new enrollment is needed.
+var ErrExpired = errors.New("certificate expired before renewal")
+
+// Renewer keep a client certificate renewed before it expires, for the
+// short-lived profiles. Renewals present the current certificate, whatever
+// Client.TLSConfig holds. Create it with NewRenewer.
+type Renewer struct {
+	Client *Client
+	// RenewBefore is the lifetime left when the certificate is renewed,
+	// a third of its validity when zero or longer than the validity.
+	RenewBefore time.Duration
+	// RetryDelay is the wait after a failed renewal, a minute when zero.
+	RetryDelay time.Duration
+	// NewKey generate a P-256 key for each renewal instead of keeping the
+	// current one.
+	NewKey bool
+	// OnRenew is called with each renewed certificate, to save it, and
+	// OnError with each failed attempt.
+	OnRenew func(cert tls.Certificate)
+	OnError func(err error)
+
+	mu sync.RWMutex
+	// certificate is the current certificate, its chain and key, see
+	// Current. Renewed certificates keep the chain.
+	certificate tls.Certificate
+}
+
+// NewRenewer return a Renewer of cert, the certificate with its chain and
+// key, requesting the renewals with client.
+func NewRenewer(client *Client, cert tls.Certificate) *Renewer {
+	return &Renewer{Client: client, certificate: cert}
+}
+
+// Current return the certificate to present, for tls.Config.GetClientCertificate.
+func (r *Renewer) Current(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cert := r.certificate
+	return &cert, nil
+}
+
+// RenewAt return when the current certificate is due for renewal.
+func (r *Renewer) RenewAt() (time.Time, error) {
+	leaf, err := r.leaf()
+	if err != nil {
+		return time.Time{}, err
+	}
+	validity := leaf.NotAfter.Sub(leaf.NotBefore)
+	before := r.RenewBefore
+	if before <= 0 || before >= validity {
+		before = validity / 3
+	}
+	return leaf.NotAfter.Add(-before), nil
+}
+
+func (r *Renewer) leaf() (*x509.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.certificate.Leaf != nil {
+		return r.certificate.Leaf, nil
+	}
+	if len(r.certificate.Certificate) == 0 {
+		return nil, errors.New("no current certificate")
+	}
+	return x509.ParseCertificate(r.certificate.Certificate[0])
+}
+
+// Run renew the certificate each time it is due, until ctx is done or
+// the certificate expired.
+func (r *Renewer) Run(ctx context.Context) error {
+	delay := r.RetryDelay
+	if delay == 0 {
+		delay = time.Minute
+	}
+	for {
+		at, err := r.RenewAt()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(at)):
+		}
+		for {
+			err := r.Renew(ctx)
+			if err == nil {
+				break
+			}
+			if r.OnError != nil {
+				r.OnError(err)
+			}
+			leaf, _ := r.leaf()
+			if leaf != nil && time.Now().After(leaf.NotAfter) {
+				return ErrExpired
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
+
+// Renew replace the current certificate now.
+func (r *Renewer) Renew(ctx context.Context) error {
+	leaf, err := r.leaf()
+	if err != nil {
+		return err
+	}
+	r.mu.RLock()
+	current := r.certificate
+	r.mu.RUnlock()
+	key, ok := current.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("the certificate key cannot sign")
+	}
+	if r.NewKey {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		RawSubject:     leaf.RawSubject,
+		DNSNames:       leaf.DNSNames,
+		IPAddresses:    leaf.IPAddresses,
+		EmailAddresses: leaf.EmailAddresses,
+		URIs:           leaf.URIs,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	c := *r.Client
+	if c.TLSConfig != nil {
+		c.TLSConfig = c.TLSConfig.Clone()
+	} else {
+		c.TLSConfig = &tls.Config{}
+	}
+	c.TLSConfig.Certificates = nil
+	c.TLSConfig.GetClientCertificate = r.Current
+	cert, _, err := c.Renew(ctx, csr)
+	if err != nil {
+		return err
+	}
+	renewed := tls.Certificate{
+		Certificate: append([][]byte{cert.Raw}, current.Certificate[1:]...),
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	r.mu.Lock()
+	r.certificate = renewed
+	r.mu.Unlock()
+	if r.OnRenew != nil {
+		r.OnRenew(renewed)
+	}
+	return nil
+}
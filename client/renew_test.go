@@ -0,0 +1,208 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/protocol"
+)
+
+// renewServer issue renewals over TLS to the peers presenting a valid
+// certificate of ca, like the signing port.
+func renewServer(t *testing.T, ca *testCA, failures int) *testServer {
+	config := ca.tlsConfig(t)
+	config.ClientAuth = tls.RequireAnyClientCert
+	var mu sync.Mutex
+	return newTestServer(t, config, func(req *protocol.Request, state *tls.ConnectionState) *protocol.Response {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeInternal, "try again")}
+		}
+		peer := state.PeerCertificates[0]
+		if err := peer.CheckSignatureFrom(ca.cert); err != nil || req.Type != protocol.TypeRenew {
+			return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeUnauthorized, "not a renewal")}
+		}
+		csr, err := x509.ParseCertificateRequest(req.CSR)
+		if err != nil || csr.Subject.CommonName != peer.Subject.CommonName {
+			return &protocol.Response{Status: protocol.StatusError, Error: protocol.Errorf(protocol.CodeBadCSR, "subject changed")}
+		}
+		return ca.sign(t, req)
+	})
+}
+
+func newRenewer(t *testing.T, ca *testCA, addr string, validity time.Duration) *Renewer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := ca.issue(t, pkix.Name{CommonName: "node"}, key.Public(), validity, x509.ExtKeyUsageClientAuth)
+	return NewRenewer(
+		&Client{Addr: addr, TLSConfig: &tls.Config{}, RootFingerprint: fingerprint(ca.cert)},
+		tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.cert.Raw}, PrivateKey: key, Leaf: leaf},
+	)
+}
+
+func current(t *testing.T, r *Renewer) *x509.Certificate {
+	cert, err := r.Current(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf
+}
+
+func TestRenew(t *testing.T) {
+	ca := newTestCA(t, "root")
+	srv := renewServer(t, ca, 0)
+	defer srv.Close()
+
+	for _, newKey := range []bool{false, true} {
+		r := newRenewer(t, ca, srv.Addr(), time.Hour)
+		r.NewKey = newKey
+		old := current(t, r)
+		var renewed []tls.Certificate
+		r.OnRenew = func(cert tls.Certificate) { renewed = append(renewed, cert) }
+		if err := r.Renew(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		leaf := current(t, r)
+		if leaf.Equal(old) || leaf.Subject.CommonName != "node" {
+			t.Fatalf("current certificate is %s, serial %s", leaf.Subject, leaf.SerialNumber)
+		}
+		if len(renewed) != 1 || !renewed[0].Leaf.Equal(leaf) {
+			t.Errorf("OnRenew called %d times", len(renewed))
+		}
+		cert, _ := r.Current(nil)
+		if len(cert.Certificate) != 2 {
+			t.Errorf("renewed chain has %d certificates, want 2", len(cert.Certificate))
+		}
+		sameKey := string(leaf.RawSubjectPublicKeyInfo) == string(old.RawSubjectPublicKeyInfo)
+		if sameKey == newKey {
+			t.Errorf("NewKey %v, key kept %v", newKey, sameKey)
+		}
+	}
+	for _, req := range srv.Requests() {
+		if req.Type != protocol.TypeRenew {
+			t.Errorf("server received a %s request", req.Type)
+		}
+	}
+}
+
+func TestRenewAt(t *testing.T) {
+	ca := newTestCA(t, "root")
+	r := newRenewer(t, ca, "", 3*time.Hour)
+	leaf := current(t, r)
+	validity := leaf.NotAfter.Sub(leaf.NotBefore)
+	tests := []struct {
+		before time.Duration
+		want   time.Time
+	}{
+		{0, leaf.NotAfter.Add(-validity / 3)},
+		{time.Hour, leaf.NotAfter.Add(-time.Hour)},
+		{validity, leaf.NotAfter.Add(-validity / 3)},
+	}
+	for _, tt := range tests {
+		r.RenewBefore = tt.before
+		at, err := r.RenewAt()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !at.Equal(tt.want) {
+			t.Errorf("RenewBefore %v: renew at %v, want %v", tt.before, at, tt.want)
+		}
+	}
+}
+
+func TestRunRetries(t *testing.T) {
+	ca := newTestCA(t, "root")
+	srv := renewServer(t, ca, 2)
+	defer srv.Close()
+
+	// valid two minutes from a minute ago, due at once
+	r := newRenewer(t, ca, srv.Addr(), time.Minute)
+	r.RenewBefore = 90 * time.Second
+	r.RetryDelay = 20 * time.Millisecond
+	old := current(t, r)
+	var mu sync.Mutex
+	var failures int
+	r.OnError = func(err error) {
+		mu.Lock()
+		failures++
+		mu.Unlock()
+	}
+	renewed := make(chan struct{}, 1)
+	r.OnRenew = func(tls.Certificate) {
+		select {
+		case renewed <- struct{}{}:
+		default:
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+
+	select {
+	case <-renewed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("not renewed")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Run returned %v, want %v", err, context.Canceled)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if failures != 2 {
+		t.Errorf("OnError called %d times, want 2", failures)
+	}
+	if current(t, r).Equal(old) {
+		t.Error("certificate not replaced")
+	}
+}
+
+func TestRunExpired(t *testing.T) {
+	ca := newTestCA(t, "root")
+	srv := renewServer(t, ca, 1000)
+	defer srv.Close()
+
+	r := newRenewer(t, ca, srv.Addr(), -time.Second)
+	r.RetryDelay = 10 * time.Millisecond
+	done := make(chan error, 1)
+	go func() { done <- r.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != ErrExpired {
+			t.Errorf("got %v, want %v", err, ErrExpired)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not give up on an expired certificate")
+	}
+}
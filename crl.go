@@ -0,0 +1,157 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// crlPublisher keep the last CRL signed by the daemon and serve it over http.
+type crlPublisher struct {
+	// issuer and key sign the CRL of the certificates of issuer, saved as
+	// cert/<name>.crl.
+	issuer *x509.Certificate
+	key    crypto.Signer
+	name   string
+
+	mu          sync.RWMutex
+	der         []byte
+	published   time.Time
+	revocations uint64
+}
+
+func crlInterval() time.Duration {
+	if conf.CRL.Interval <= 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.CRL.Interval) * time.Minute
+}
+
+func crlValidity() time.Duration {
+	if conf.CRL.Validity <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(conf.CRL.Validity) * time.Hour
+}
+
+// crlURL return the CRL distribution point embedded in issued certificates.
+func crlURL() string {
+	if conf.HTTPListen == "" || conf.PublicURL == "" {
+		return ""
+	}
+	return conf.PublicURL + "/crl"
+}
+
+// publish sign a new CRL, save it in the cert folder and serve it.
+func (p *crlPublisher) publish(rca *rootCA) error {
+	revocations, err := rca.store.Revocations()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	all, err := rca.store.RevokedCertificates(now)
+	if err != nil {
+		return err
+	}
+	revoked := all[:0]
+	for _, rec := range all {
+		if p.lists(rec) {
+			revoked = append(revoked, rec)
+		}
+	}
+	number, err := rca.store.NextCRLNumber()
+	if err != nil {
+		return err
+	}
+	nextUpdate := now.Add(crlValidity())
+	der, err := ca.CreateCRL(p.issuer, p.key, revoked, number, now, nextUpdate)
+	if err != nil {
+		return err
+	}
+	crlFile := path.Join(exPath, "cert/"+p.name+".crl")
+	if err := ioutil.WriteFile(crlFile, der, 0644); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.der = der
+	p.published = now
+	p.revocations = revocations
+	p.mu.Unlock()
+	log.Printf("CRL #%v of %s published with %d revoked certificates.", number, p.issuer.Subject.CommonName, len(revoked))
+	return nil
+}
+
+// lists tell if the inventory record rec is a certificate of the CRL
+// issuer, records that do not parse are kept.
+func (p *crlPublisher) lists(rec models.Certificate) bool {
+	cert, err := x509.ParseCertificate(rec.Raw)
+	return err != nil || cert.CheckSignatureFrom(p.issuer) == nil
+}
+
+// stale tell if a revocation happened or the interval elapsed since the
+// last CRL.
+func (p *crlPublisher) stale(rca *rootCA) bool {
+	revocations, err := rca.store.Revocations()
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.der == nil || revocations != p.revocations || time.Since(p.published) >= crlInterval()
+}
+
+// run publish the CRL until stop is closed, revocations made with the cli
+// are picked up within a minute.
+func (p *crlPublisher) run(rca *rootCA, stop <-chan bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		if p.stale(rca) {
+			if err := p.publish(rca); err != nil {
+				log.Errorln("CRL publication failed: ", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *crlPublisher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	der := p.der
+	p.mu.RUnlock()
+	if der == nil {
+		http.Error(w, "CRL not yet available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(der)
+}
@@ -0,0 +1,46 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var acmeBucket = []byte("acme")
+
+// ACME load the ACME object kind/id into v.
+func (s *Store) ACME(kind, id string, v interface{}) error {
+	return s.view(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(acmeBucket).Get([]byte(kind + "/" + id))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(raw, v)
+	})
+}
+
+// PutACME save the ACME object kind/id.
+func (s *Store) PutACME(kind, id string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(acmeBucket).Put([]byte(kind+"/"+id), raw)
+	})
+}
@@ -0,0 +1,409 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package db is the ezb_pki inventory, an embedded bolt database holding
+// every certificate issued by the CA.
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	certificatesBucket = []byte("certificates")
+	metaBucket         = []byte("meta")
+	// fingerprintsBucket and commonNamesBucket index the certificates,
+	// keyed by indexKey.
+	fingerprintsBucket = []byte("fingerprints")
+	commonNamesBucket  = []byte("commonnames")
+)
+
+var (
+	crlNumberKey   = []byte("crlnumber")
+	revocationsKey = []byte("revocations")
+)
+
+// ErrNotFound is returned when a record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrLocked is returned by Open when another process keeps the database
+// open, the running service holds it until it stops.
+var ErrLocked = errors.New("database in use by another process, stop the service first")
+
+// openAttempts and openTimeout bound the wait of Open for the database lock.
+const (
+	openAttempts = 3
+	openTimeout  = 2 * time.Second
+)
+
+// Store gives access to the inventory database. The bolt file stays open,
+// and locked, until Close: the service keeps it for its whole lifetime, the
+// cli commands for their run.
+type Store struct {
+	file string
+	db   *bolt.DB
+}
+
+// Open open the database file, retrying a few times while another process
+// holds it, and create the buckets and indexes if needed.
+func Open(file string) (*Store, error) {
+	var b *bolt.DB
+	var err error
+	for attempt := 1; ; attempt++ {
+		b, err = bolt.Open(file, 0600, &bolt.Options{Timeout: openTimeout})
+		if err != bolt.ErrTimeout || attempt == openAttempts {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+	}
+	if err == bolt.ErrTimeout {
+		err = ErrLocked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", file, err)
+	}
+	s := &Store{file: file, db: b}
+	err = s.update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{certificatesBucket, metaBucket, tokensBucket, requestsBucket, acmeBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return createIndexes(tx)
+	})
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close release the database file.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	return s.db.Update(fn)
+}
+
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	return s.db.View(fn)
+}
+
+// createIndexes create the missing index buckets and fill them from the
+// certificates already recorded, databases of older versions have none.
+func createIndexes(tx *bolt.Tx) error {
+	if tx.Bucket(fingerprintsBucket) != nil && tx.Bucket(commonNamesBucket) != nil {
+		return nil
+	}
+	for _, name := range [][]byte{fingerprintsBucket, commonNamesBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(certificatesBucket).ForEach(func(k, v []byte) error {
+		var rec models.Certificate
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		return indexCertificate(tx, &rec)
+	})
+}
+
+// indexKey return the index key of the certificate serial under value,
+// the records of a value are the keys prefixed by value and a NUL byte.
+func indexKey(value string, serial string) []byte {
+	return []byte(value + "\x00" + serial)
+}
+
+func indexCertificate(tx *bolt.Tx, rec *models.Certificate) error {
+	if err := tx.Bucket(fingerprintsBucket).Put(indexKey(rec.Fingerprint, rec.Serial), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(commonNamesBucket).Put(indexKey(rec.CommonName, rec.Serial), nil)
+}
+
+// indexed return the records listed under value in the index bucket.
+func (s *Store) indexed(index []byte, value string) ([]models.Certificate, error) {
+	var list []models.Certificate
+	err := s.view(func(tx *bolt.Tx) error {
+		certs := tx.Bucket(certificatesBucket)
+		prefix := indexKey(value, "")
+		c := tx.Bucket(index).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			raw := certs.Get(k[len(prefix):])
+			if raw == nil {
+				continue
+			}
+			var rec models.Certificate
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+			list = append(list, rec)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// SerialKey return the inventory key of a serial number.
+func SerialKey(serial *big.Int) string {
+	return fmt.Sprintf("%X", serial)
+}
+
+// Fingerprint return the hex SHA-256 of the certificate public key.
+func Fingerprint(cert *x509.Certificate) string {
+	return KeyFingerprint(cert.RawSubjectPublicKeyInfo)
+}
+
+// KeyFingerprint return the hex SHA-256 of a DER SubjectPublicKeyInfo.
+func KeyFingerprint(spki []byte) string {
+	fp := sha256.Sum256(spki)
+	return hex.EncodeToString(fp[:])
+}
+
+// NewCertificate build the inventory record of an issued certificate.
+func NewCertificate(cert *x509.Certificate, requester string) *models.Certificate {
+	rec := &models.Certificate{
+		Serial:      SerialKey(cert.SerialNumber),
+		CommonName:  cert.Subject.CommonName,
+		Subject:     cert.Subject.String(),
+		DNSNames:    cert.DNSNames,
+		Emails:      cert.EmailAddresses,
+		Fingerprint: Fingerprint(cert),
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+		Requester:   requester,
+		Status:      models.StatusValid,
+		IssuedAt:    time.Now(),
+		Raw:         cert.Raw,
+	}
+	for _, ip := range cert.IPAddresses {
+		rec.IPAddresses = append(rec.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		rec.URIs = append(rec.URIs, uri.String())
+	}
+	return rec
+}
+
+// AddCertificate record a newly issued certificate. Serials must be unique.
+func (s *Store) AddCertificate(rec *models.Certificate) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		if b.Get([]byte(rec.Serial)) != nil {
+			return fmt.Errorf("serial %s already recorded", rec.Serial)
+		}
+		if err := b.Put([]byte(rec.Serial), raw); err != nil {
+			return err
+		}
+		return indexCertificate(tx, rec)
+	})
+}
+
+// Certificate return the record of serial.
+func (s *Store) Certificate(serial string) (*models.Certificate, error) {
+	var rec models.Certificate
+	err := s.view(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(certificatesBucket).Get([]byte(serial))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(raw, &rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// UpdateCertificate apply fn to the record of serial and save it.
+func (s *Store) UpdateCertificate(serial string, fn func(rec *models.Certificate) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		raw := b.Get([]byte(serial))
+		if raw == nil {
+			return ErrNotFound
+		}
+		var rec models.Certificate
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		if err := fn(&rec); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(serial), raw)
+	})
+}
+
+// Certificates return every record accepted by filter, all records if
+// filter is nil.
+func (s *Store) Certificates(filter func(rec *models.Certificate) bool) ([]models.Certificate, error) {
+	var list []models.Certificate
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(certificatesBucket).ForEach(func(k, v []byte) error {
+			var rec models.Certificate
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if filter == nil || filter(&rec) {
+				list = append(list, rec)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
+
+// CertificatesByCommonName return the records issued to cn.
+func (s *Store) CertificatesByCommonName(cn string) ([]models.Certificate, error) {
+	return s.indexed(commonNamesBucket, cn)
+}
+
+// LinkRenewal record that the certificate renewed replaced old at.
+func (s *Store) LinkRenewal(old string, renewed string, at time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		for _, serial := range []string{old, renewed} {
+			raw := b.Get([]byte(serial))
+			if raw == nil {
+				return ErrNotFound
+			}
+			var rec models.Certificate
+			if err := json.Unmarshal(raw, &rec); err != nil {
+				return err
+			}
+			if serial == old {
+				rec.RenewedBy = renewed
+				rec.RenewedAt = at
+			} else {
+				rec.Renews = old
+			}
+			raw, err := json.Marshal(&rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(serial), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CertificatesByFingerprint return the records of the public key
+// fingerprint, see Fingerprint.
+func (s *Store) CertificatesByFingerprint(fp string) ([]models.Certificate, error) {
+	return s.indexed(fingerprintsBucket, fp)
+}
+
+// Revoke mark the certificate serial as revoked with an RFC 5280 reason code.
+func (s *Store) Revoke(serial string, reason int, at time.Time) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(certificatesBucket)
+		raw := b.Get([]byte(serial))
+		if raw == nil {
+			return ErrNotFound
+		}
+		var rec models.Certificate
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			return err
+		}
+		if rec.Status == models.StatusRevoked {
+			return fmt.Errorf("serial %s already revoked", serial)
+		}
+		rec.Status = models.StatusRevoked
+		rec.RevokedAt = at
+		rec.RevocationReason = reason
+		raw, err := json.Marshal(&rec)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(serial), raw); err != nil {
+			return err
+		}
+		_, err = increment(tx.Bucket(metaBucket), revocationsKey)
+		return err
+	})
+}
+
+// RevokedCertificates return the revoked records still to be listed in
+// the CRL, expired certificates are dropped.
+func (s *Store) RevokedCertificates(now time.Time) ([]models.Certificate, error) {
+	return s.Certificates(func(rec *models.Certificate) bool {
+		return rec.Status == models.StatusRevoked && now.Before(rec.NotAfter)
+	})
+}
+
+// Revocations return a counter incremented on each revocation, used to
+// detect that a new CRL is needed.
+func (s *Store) Revocations() (uint64, error) {
+	var n uint64
+	err := s.view(func(tx *bolt.Tx) error {
+		n = counter(tx.Bucket(metaBucket), revocationsKey)
+		return nil
+	})
+	return n, err
+}
+
+// NextCRLNumber return a new, monotonically increasing, CRL number.
+func (s *Store) NextCRLNumber() (*big.Int, error) {
+	var n uint64
+	err := s.update(func(tx *bolt.Tx) error {
+		var err error
+		n, err = increment(tx.Bucket(metaBucket), crlNumberKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetUint64(n), nil
+}
+
+func counter(b *bolt.Bucket, key []byte) uint64 {
+	raw := b.Get(key)
+	if len(raw) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(raw)
+}
+
+func increment(b *bolt.Bucket, key []byte) (uint64, error) {
+	n := counter(b, key) + 1
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, n)
+	return n, b.Put(key, raw)
+}
@@ -0,0 +1,117 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/ezbastion/ezb_pki/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var requestsBucket = []byte("requests")
+
+// RequestID return the approval queue id of a DER encoded CSR. The same
+// CSR always get the same id, so a client can poll by sending it again.
+func RequestID(csr []byte) string {
+	h := sha256.Sum256(csr)
+	return hex.EncodeToString(h[:8])
+}
+
+// AddRequest queue req, an existing request with the same id is returned
+// untouched instead.
+func (s *Store) AddRequest(req *models.Request) (*models.Request, error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var existing *models.Request
+	err = s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		if v := b.Get([]byte(req.ID)); v != nil {
+			existing = new(models.Request)
+			return json.Unmarshal(v, existing)
+		}
+		return b.Put([]byte(req.ID), raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
+	return req, nil
+}
+
+// Request return the queued request id.
+func (s *Store) Request(id string) (*models.Request, error) {
+	var req models.Request
+	err := s.view(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(requestsBucket).Get([]byte(id))
+		if raw == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(raw, &req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// UpdateRequest apply fn to the request id and save it.
+func (s *Store) UpdateRequest(id string, fn func(req *models.Request) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		raw := b.Get([]byte(id))
+		if raw == nil {
+			return ErrNotFound
+		}
+		var req models.Request
+		if err := json.Unmarshal(raw, &req); err != nil {
+			return err
+		}
+		if err := fn(&req); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(&req)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), raw)
+	})
+}
+
+// Requests return every queued request accepted by filter, all requests
+// if filter is nil.
+func (s *Store) Requests(filter func(req *models.Request) bool) ([]models.Request, error) {
+	var list []models.Request
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).ForEach(func(k, v []byte) error {
+			var req models.Request
+			if err := json.Unmarshal(v, &req); err != nil {
+				return err
+			}
+			if filter == nil || filter(&req) {
+				list = append(list, req)
+			}
+			return nil
+		})
+	})
+	return list, err
+}
@@ -0,0 +1,131 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+var tokensBucket = []byte("tokens")
+
+// TokenHash return the key under which the token secret is stored.
+func TokenHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// AddToken record a new enrollment token.
+func (s *Store) AddToken(token *models.Token) error {
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		if b.Get([]byte(token.Hash)) != nil {
+			return fmt.Errorf("token %s already exists", token.ID)
+		}
+		return b.Put([]byte(token.Hash), raw)
+	})
+}
+
+// UseToken look up the unused, unexpired token matching secret and let
+// check accept it. The token is marked used by usedBy in the same
+// transaction, so it can be redeemed only once, and returned.
+func (s *Store) UseToken(secret string, usedBy string, check func(token *models.Token) error) (*models.Token, error) {
+	key := []byte(TokenHash(secret))
+	var token models.Token
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		raw := b.Get(key)
+		if raw == nil {
+			return ErrNotFound
+		}
+		if err := json.Unmarshal(raw, &token); err != nil {
+			return err
+		}
+		if !token.UsedAt.IsZero() {
+			return fmt.Errorf("token %s already used", token.ID)
+		}
+		if time.Now().After(token.ExpiresAt) {
+			return fmt.Errorf("token %s expired", token.ID)
+		}
+		if err := check(&token); err != nil {
+			return err
+		}
+		token.UsedAt = time.Now()
+		token.UsedBy = usedBy
+		raw, err := json.Marshal(&token)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// ReleaseToken mark unused again a token redeemed by UseToken, when the
+// request it authorized failed. A token redeemed since is left alone.
+func (s *Store) ReleaseToken(token *models.Token) error {
+	key := []byte(token.Hash)
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(tokensBucket)
+		raw := b.Get(key)
+		if raw == nil {
+			return ErrNotFound
+		}
+		var current models.Token
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return err
+		}
+		if !current.UsedAt.Equal(token.UsedAt) || current.UsedBy != token.UsedBy {
+			return nil
+		}
+		current.UsedAt = time.Time{}
+		current.UsedBy = ""
+		raw, err := json.Marshal(&current)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, raw)
+	})
+}
+
+// Tokens return every enrollment token.
+func (s *Store) Tokens() ([]models.Token, error) {
+	var list []models.Token
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).ForEach(func(k, v []byte) error {
+			var token models.Token
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			list = append(list, token)
+			return nil
+		})
+	})
+	return list, err
+}
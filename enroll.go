@@ -0,0 +1,144 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// enrollment is a certificate request received on any transport.
+// profile and token are optional, peer is the client certificate when
+// the client authenticated with one.
+type enrollment struct {
+	csr       *x509.CertificateRequest
+	profile   string
+	token     string
+	requester string
+	peer      *x509.Certificate
+}
+
+// renewal tell if the request renews the client certificate: a peer
+// sending no token nor challenge password, or asking for its own common
+// name. Other peers enroll with their token like any node.
+func (e *enrollment) renewal() bool {
+	if e.peer == nil {
+		return false
+	}
+	if e.csr.Subject.CommonName == e.peer.Subject.CommonName {
+		return true
+	}
+	password, _ := ca.ChallengePassword(e.csr)
+	return e.token == "" && password == ""
+}
+
+// enroll authorize the request and return the issued certificate, or the
+// approval queue entry while pending. Errors meant for the client are
+// *protocol.Error.
+func (rca *rootCA) enroll(e *enrollment) (*x509.Certificate, *models.Request, error) {
+	if err := e.csr.CheckSignature(); err != nil {
+		return nil, nil, protocol.Errorf(protocol.CodeBadCSR, "%v", err)
+	}
+	var current *models.Certificate
+	var token *models.Token
+	var err error
+	if e.renewal() {
+		current, err = authorizeRenewal(rca.store, e.csr, e.peer)
+	} else {
+		token, err = authorizeCSR(rca.store, e.csr, e.token, e.requester)
+	}
+	switch {
+	case err == errTokenRequired && conf.Approval:
+		profile, err := rca.enrollableProfile(e.csr, e.profile, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		return rca.queueCSR(e.csr, profile.Name, e.requester)
+	case err != nil:
+		log.Warningf("Enrollment of %s refused: %v", e.csr.Subject.CommonName, err)
+		return nil, nil, protocol.Errorf(protocol.CodeUnauthorized, "%v", err)
+	}
+	if current != nil {
+		cert, err := rca.renew(e.csr, current, e.peer, e.requester)
+		return cert, nil, err
+	}
+	var bound string
+	if token != nil {
+		bound = token.Profile
+	}
+	cert, err := rca.issueCSR(e.csr, e.profile, bound, e.requester)
+	if err != nil && token != nil {
+		if err := rca.store.ReleaseToken(token); err != nil {
+			log.Errorf("Release of token %s: %v", token.ID, err)
+		}
+	}
+	return cert, nil, err
+}
+
+// applyPolicy check template and csr against the configured policy, the
+// rejection reasons are logged and sent to the client.
+func (rca *rootCA) applyPolicy(template *x509.Certificate, csr *x509.CertificateRequest) error {
+	if err := rca.policy.Apply(template, csr); err != nil {
+		log.Warningf("Request of %s refused by %v", csr.Subject.CommonName, err)
+		return protocol.Errorf(protocol.CodeRefused, "%v", err)
+	}
+	return nil
+}
+
+// enrollableProfile select the profile of a new certificate like
+// selectProfile, bound is the profile of the redeemed token and replaces
+// the requested one. The API profiles are only issued with a token bound
+// to them.
+func (rca *rootCA) enrollableProfile(csr *x509.CertificateRequest, name string, bound string) (*ca.Profile, error) {
+	if bound != "" {
+		name = bound
+	}
+	profile, err := rca.selectProfile(csr, name)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeRefused, "%v", err)
+	}
+	if isAPIProfile(profile.Name) && profile.Name != bound {
+		log.Warningf("Request of %s for profile %s refused, it needs a token bound to it", csr.Subject.CommonName, profile.Name)
+		return nil, protocol.Errorf(protocol.CodeRefused, "profile %s is only issued with an enrollment token bound to it", profile.Name)
+	}
+	return profile, nil
+}
+
+// issueCSR sign a node certificate for an authorized request with the
+// profile name, or the profile selected by the request, see
+// enrollableProfile.
+func (rca *rootCA) issueCSR(csr *x509.CertificateRequest, name string, bound string, requester string) (*x509.Certificate, error) {
+	profile, err := rca.enrollableProfile(csr, name, bound)
+	if err != nil {
+		return nil, err
+	}
+	template, err := profile.Template(csr, time.Now())
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeRefused, "%v", err)
+	}
+	if err = rca.applyPolicy(template, csr); err != nil {
+		return nil, err
+	}
+	if !profile.ShortLived {
+		addRevocationInfo(template)
+	}
+	return rca.issue(template, csr.PublicKey, profile.Name, requester)
+}
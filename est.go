@@ -0,0 +1,191 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/pkcs7"
+)
+
+const estPrefix = "/.well-known/est/"
+
+var (
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// startESTServer serve the EST (RFC 7030) endpoints over TLS on
+// conf.EST.Listen until stop is closed. Clients authenticate with an
+// enrollment token as HTTP Basic password or with a certificate of ours.
+func startESTServer(rca *rootCA, stop <-chan bool) {
+	if conf.EST.Listen == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", conf.EST.Listen)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(rca.serveEST)}
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+	log.Println("EST listen at ", conf.EST.Listen)
+	if err := srv.Serve(tls.NewListener(listener, rca.tlsConfig())); err != nil && err != http.ErrServerClosed {
+		log.Errorln(err)
+	}
+}
+
+// serveEST route /.well-known/est/[label/]operation, the optional label
+// is the profile name.
+func (rca *rootCA) serveEST(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, estPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, estPrefix), "/")
+	profile := conf.EST.Profile
+	if len(parts) == 2 {
+		profile, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch op := parts[0]; {
+	case op == "cacerts" && r.Method == http.MethodGet:
+		rca.estCACerts(w)
+	case op == "csrattrs" && r.Method == http.MethodGet:
+		estCSRAttrs(w)
+	case op == "simpleenroll" && r.Method == http.MethodPost:
+		rca.estEnroll(w, r, profile, false)
+	case op == "simplereenroll" && r.Method == http.MethodPost:
+		rca.estEnroll(w, r, profile, true)
+	case op == "cacerts" || op == "csrattrs" || op == "simpleenroll" || op == "simplereenroll":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (rca *rootCA) estCACerts(w http.ResponseWriter) {
+	writeCertsOnly(w, rca.chain...)
+}
+
+// estCSRAttrs ask for the enrollment token in the CSR when tokens are
+// required, and for ECDSA with SHA-256 signatures.
+func estCSRAttrs(w http.ResponseWriter) {
+	attrs := []asn1.ObjectIdentifier{oidECDSAWithSHA256}
+	if !conf.AutoEnrollment {
+		attrs = append(attrs, oidChallengePassword)
+	}
+	der, err := asn1.Marshal(attrs)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/csrattrs")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(der)))
+}
+
+// estEnroll sign the request body. Reenrollment requires the client
+// certificate or an enrollment token.
+func (rca *rootCA) estEnroll(w http.ResponseWriter, r *http.Request, profile string, reenroll bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxFrameSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		// some clients post the DER itself.
+		der = body
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var peer *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		peer = r.TLS.PeerCertificates[0]
+	}
+	_, token, _ := r.BasicAuth()
+	if reenroll && peer == nil && token == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ezb_pki"`)
+		http.Error(w, "client certificate or enrollment token required", http.StatusUnauthorized)
+		return
+	}
+
+	cert, req, err := rca.enroll(&enrollment{
+		csr:       csr,
+		profile:   profile,
+		token:     token,
+		requester: "est:" + r.RemoteAddr,
+		peer:      peer,
+	})
+	switch perr, _ := err.(*protocol.Error); {
+	case err == nil && cert == nil:
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("request " + req.ID + " pending\n"))
+	case err == nil:
+		log.Println("Transmitted client Certificate to ", cert.Subject.CommonName, " over EST")
+		writeCertsOnly(w, cert.Raw)
+	case perr == nil:
+		log.Errorln(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	case perr.Code == protocol.CodeUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Basic realm="ezb_pki"`)
+		http.Error(w, perr.Message, http.StatusUnauthorized)
+	case perr.Code == protocol.CodeBadCSR:
+		http.Error(w, perr.Message, http.StatusBadRequest)
+	default:
+		http.Error(w, perr.Message, http.StatusForbidden)
+	}
+}
+
+// writeCertsOnly answer a base64 certs-only PKCS#7 of the DER certificates.
+func writeCertsOnly(w http.ResponseWriter, certs ...[]byte) {
+	var concat []byte
+	for _, der := range certs {
+		concat = append(concat, der...)
+	}
+	p7, err := pkcs7.DegenerateCertificate(concat)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(p7)))
+}
@@ -0,0 +1,813 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: ezbpki.proto
+
+package ezbpki
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Status int32
+
+const (
+	Status_STATUS_UNSPECIFIED Status = 0
+	Status_STATUS_ISSUED      Status = 1
+	Status_STATUS_PENDING     Status = 2
+)
+
+var Status_name = map[int32]string{
+	0: "STATUS_UNSPECIFIED",
+	1: "STATUS_ISSUED",
+	2: "STATUS_PENDING",
+}
+
+var Status_value = map[string]int32{
+	"STATUS_UNSPECIFIED": 0,
+	"STATUS_ISSUED":      1,
+	"STATUS_PENDING":     2,
+}
+
+func (x Status) String() string {
+	return proto.EnumName(Status_name, int32(x))
+}
+
+func (Status) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{0}
+}
+
+type SignRequest struct {
+	// DER encoded PKCS#10 request.
+	Csr []byte `protobuf:"bytes,1,opt,name=csr,proto3" json:"csr,omitempty"`
+	// Certificate profile, the one requested by the CSR or the default one
+	// when empty.
+	Profile string `protobuf:"bytes,2,opt,name=profile,proto3" json:"profile,omitempty"`
+	// Enrollment token.
+	Token                string   `protobuf:"bytes,3,opt,name=token,proto3" json:"token,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SignRequest) Reset()         { *m = SignRequest{} }
+func (m *SignRequest) String() string { return proto.CompactTextString(m) }
+func (*SignRequest) ProtoMessage()    {}
+func (*SignRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{0}
+}
+
+func (m *SignRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SignRequest.Unmarshal(m, b)
+}
+func (m *SignRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SignRequest.Marshal(b, m, deterministic)
+}
+func (m *SignRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SignRequest.Merge(m, src)
+}
+func (m *SignRequest) XXX_Size() int {
+	return xxx_messageInfo_SignRequest.Size(m)
+}
+func (m *SignRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SignRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SignRequest proto.InternalMessageInfo
+
+func (m *SignRequest) GetCsr() []byte {
+	if m != nil {
+		return m.Csr
+	}
+	return nil
+}
+
+func (m *SignRequest) GetProfile() string {
+	if m != nil {
+		return m.Profile
+	}
+	return ""
+}
+
+func (m *SignRequest) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
+type RenewRequest struct {
+	// DER encoded PKCS#10 request.
+	Csr                  []byte   `protobuf:"bytes,1,opt,name=csr,proto3" json:"csr,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RenewRequest) Reset()         { *m = RenewRequest{} }
+func (m *RenewRequest) String() string { return proto.CompactTextString(m) }
+func (*RenewRequest) ProtoMessage()    {}
+func (*RenewRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{1}
+}
+
+func (m *RenewRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RenewRequest.Unmarshal(m, b)
+}
+func (m *RenewRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RenewRequest.Marshal(b, m, deterministic)
+}
+func (m *RenewRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RenewRequest.Merge(m, src)
+}
+func (m *RenewRequest) XXX_Size() int {
+	return xxx_messageInfo_RenewRequest.Size(m)
+}
+func (m *RenewRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RenewRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RenewRequest proto.InternalMessageInfo
+
+func (m *RenewRequest) GetCsr() []byte {
+	if m != nil {
+		return m.Csr
+	}
+	return nil
+}
+
+type SignResponse struct {
+	Status Status `protobuf:"varint,1,opt,name=status,proto3,enum=ezbpki.v1.Status" json:"status,omitempty"`
+	// DER encoded certificate when ISSUED.
+	Certificate []byte `protobuf:"bytes,2,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	// DER encoded CA certificates when ISSUED.
+	Chain [][]byte `protobuf:"bytes,3,rep,name=chain,proto3" json:"chain,omitempty"`
+	// Approval queue id when PENDING.
+	RequestId            string   `protobuf:"bytes,4,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *SignResponse) Reset()         { *m = SignResponse{} }
+func (m *SignResponse) String() string { return proto.CompactTextString(m) }
+func (*SignResponse) ProtoMessage()    {}
+func (*SignResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{2}
+}
+
+func (m *SignResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SignResponse.Unmarshal(m, b)
+}
+func (m *SignResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SignResponse.Marshal(b, m, deterministic)
+}
+func (m *SignResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SignResponse.Merge(m, src)
+}
+func (m *SignResponse) XXX_Size() int {
+	return xxx_messageInfo_SignResponse.Size(m)
+}
+func (m *SignResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_SignResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SignResponse proto.InternalMessageInfo
+
+func (m *SignResponse) GetStatus() Status {
+	if m != nil {
+		return m.Status
+	}
+	return Status_STATUS_UNSPECIFIED
+}
+
+func (m *SignResponse) GetCertificate() []byte {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
+func (m *SignResponse) GetChain() [][]byte {
+	if m != nil {
+		return m.Chain
+	}
+	return nil
+}
+
+func (m *SignResponse) GetRequestId() string {
+	if m != nil {
+		return m.RequestId
+	}
+	return ""
+}
+
+type RevokeRequest struct {
+	// Hexadecimal serial number.
+	Serial string `protobuf:"bytes,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	// RFC 5280 reason name or code, unspecified when empty.
+	Reason               string   `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevokeRequest) Reset()         { *m = RevokeRequest{} }
+func (m *RevokeRequest) String() string { return proto.CompactTextString(m) }
+func (*RevokeRequest) ProtoMessage()    {}
+func (*RevokeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{3}
+}
+
+func (m *RevokeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevokeRequest.Unmarshal(m, b)
+}
+func (m *RevokeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevokeRequest.Marshal(b, m, deterministic)
+}
+func (m *RevokeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevokeRequest.Merge(m, src)
+}
+func (m *RevokeRequest) XXX_Size() int {
+	return xxx_messageInfo_RevokeRequest.Size(m)
+}
+func (m *RevokeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevokeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevokeRequest proto.InternalMessageInfo
+
+func (m *RevokeRequest) GetSerial() string {
+	if m != nil {
+		return m.Serial
+	}
+	return ""
+}
+
+func (m *RevokeRequest) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type RevokeResponse struct {
+	Serial string `protobuf:"bytes,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	// Revocation time, seconds since the epoch.
+	RevokedAt            int64    `protobuf:"varint,2,opt,name=revoked_at,json=revokedAt,proto3" json:"revoked_at,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *RevokeResponse) Reset()         { *m = RevokeResponse{} }
+func (m *RevokeResponse) String() string { return proto.CompactTextString(m) }
+func (*RevokeResponse) ProtoMessage()    {}
+func (*RevokeResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{4}
+}
+
+func (m *RevokeResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_RevokeResponse.Unmarshal(m, b)
+}
+func (m *RevokeResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_RevokeResponse.Marshal(b, m, deterministic)
+}
+func (m *RevokeResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_RevokeResponse.Merge(m, src)
+}
+func (m *RevokeResponse) XXX_Size() int {
+	return xxx_messageInfo_RevokeResponse.Size(m)
+}
+func (m *RevokeResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_RevokeResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_RevokeResponse proto.InternalMessageInfo
+
+func (m *RevokeResponse) GetSerial() string {
+	if m != nil {
+		return m.Serial
+	}
+	return ""
+}
+
+func (m *RevokeResponse) GetRevokedAt() int64 {
+	if m != nil {
+		return m.RevokedAt
+	}
+	return 0
+}
+
+type GetChainRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetChainRequest) Reset()         { *m = GetChainRequest{} }
+func (m *GetChainRequest) String() string { return proto.CompactTextString(m) }
+func (*GetChainRequest) ProtoMessage()    {}
+func (*GetChainRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{5}
+}
+
+func (m *GetChainRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetChainRequest.Unmarshal(m, b)
+}
+func (m *GetChainRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetChainRequest.Marshal(b, m, deterministic)
+}
+func (m *GetChainRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetChainRequest.Merge(m, src)
+}
+func (m *GetChainRequest) XXX_Size() int {
+	return xxx_messageInfo_GetChainRequest.Size(m)
+}
+func (m *GetChainRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetChainRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetChainRequest proto.InternalMessageInfo
+
+type GetChainResponse struct {
+	// DER encoded CA certificates, from the issuing CA up to the root.
+	Certificates         [][]byte `protobuf:"bytes,1,rep,name=certificates,proto3" json:"certificates,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetChainResponse) Reset()         { *m = GetChainResponse{} }
+func (m *GetChainResponse) String() string { return proto.CompactTextString(m) }
+func (*GetChainResponse) ProtoMessage()    {}
+func (*GetChainResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{6}
+}
+
+func (m *GetChainResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetChainResponse.Unmarshal(m, b)
+}
+func (m *GetChainResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetChainResponse.Marshal(b, m, deterministic)
+}
+func (m *GetChainResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetChainResponse.Merge(m, src)
+}
+func (m *GetChainResponse) XXX_Size() int {
+	return xxx_messageInfo_GetChainResponse.Size(m)
+}
+func (m *GetChainResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetChainResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetChainResponse proto.InternalMessageInfo
+
+func (m *GetChainResponse) GetCertificates() [][]byte {
+	if m != nil {
+		return m.Certificates
+	}
+	return nil
+}
+
+type WatchRevocationsRequest struct {
+	// Send the current revocations before the new ones.
+	IncludeExisting      bool     `protobuf:"varint,1,opt,name=include_existing,json=includeExisting,proto3" json:"include_existing,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchRevocationsRequest) Reset()         { *m = WatchRevocationsRequest{} }
+func (m *WatchRevocationsRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRevocationsRequest) ProtoMessage()    {}
+func (*WatchRevocationsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{7}
+}
+
+func (m *WatchRevocationsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchRevocationsRequest.Unmarshal(m, b)
+}
+func (m *WatchRevocationsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchRevocationsRequest.Marshal(b, m, deterministic)
+}
+func (m *WatchRevocationsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchRevocationsRequest.Merge(m, src)
+}
+func (m *WatchRevocationsRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchRevocationsRequest.Size(m)
+}
+func (m *WatchRevocationsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchRevocationsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchRevocationsRequest proto.InternalMessageInfo
+
+func (m *WatchRevocationsRequest) GetIncludeExisting() bool {
+	if m != nil {
+		return m.IncludeExisting
+	}
+	return false
+}
+
+type Revocation struct {
+	Serial     string `protobuf:"bytes,1,opt,name=serial,proto3" json:"serial,omitempty"`
+	CommonName string `protobuf:"bytes,2,opt,name=common_name,json=commonName,proto3" json:"common_name,omitempty"`
+	// Revocation time, seconds since the epoch.
+	RevokedAt int64 `protobuf:"varint,3,opt,name=revoked_at,json=revokedAt,proto3" json:"revoked_at,omitempty"`
+	// RFC 5280 reason name.
+	Reason               string   `protobuf:"bytes,4,opt,name=reason,proto3" json:"reason,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Revocation) Reset()         { *m = Revocation{} }
+func (m *Revocation) String() string { return proto.CompactTextString(m) }
+func (*Revocation) ProtoMessage()    {}
+func (*Revocation) Descriptor() ([]byte, []int) {
+	return fileDescriptor_123ae44800343562, []int{8}
+}
+
+func (m *Revocation) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Revocation.Unmarshal(m, b)
+}
+func (m *Revocation) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Revocation.Marshal(b, m, deterministic)
+}
+func (m *Revocation) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Revocation.Merge(m, src)
+}
+func (m *Revocation) XXX_Size() int {
+	return xxx_messageInfo_Revocation.Size(m)
+}
+func (m *Revocation) XXX_DiscardUnknown() {
+	xxx_messageInfo_Revocation.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Revocation proto.InternalMessageInfo
+
+func (m *Revocation) GetSerial() string {
+	if m != nil {
+		return m.Serial
+	}
+	return ""
+}
+
+func (m *Revocation) GetCommonName() string {
+	if m != nil {
+		return m.CommonName
+	}
+	return ""
+}
+
+func (m *Revocation) GetRevokedAt() int64 {
+	if m != nil {
+		return m.RevokedAt
+	}
+	return 0
+}
+
+func (m *Revocation) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterEnum("ezbpki.v1.Status", Status_name, Status_value)
+	proto.RegisterType((*SignRequest)(nil), "ezbpki.v1.SignRequest")
+	proto.RegisterType((*RenewRequest)(nil), "ezbpki.v1.RenewRequest")
+	proto.RegisterType((*SignResponse)(nil), "ezbpki.v1.SignResponse")
+	proto.RegisterType((*RevokeRequest)(nil), "ezbpki.v1.RevokeRequest")
+	proto.RegisterType((*RevokeResponse)(nil), "ezbpki.v1.RevokeResponse")
+	proto.RegisterType((*GetChainRequest)(nil), "ezbpki.v1.GetChainRequest")
+	proto.RegisterType((*GetChainResponse)(nil), "ezbpki.v1.GetChainResponse")
+	proto.RegisterType((*WatchRevocationsRequest)(nil), "ezbpki.v1.WatchRevocationsRequest")
+	proto.RegisterType((*Revocation)(nil), "ezbpki.v1.Revocation")
+}
+
+func init() {
+	proto.RegisterFile("ezbpki.proto", fileDescriptor_123ae44800343562)
+}
+
+var fileDescriptor_123ae44800343562 = []byte{
+	// 555 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x94, 0x7f, 0x6f, 0xd2, 0x40,
+	0x18, 0xc7, 0xed, 0xca, 0x70, 0x3c, 0x74, 0xac, 0x5c, 0x94, 0x55, 0x8c, 0x91, 0xf4, 0x2f, 0x66,
+	0x22, 0xb8, 0x99, 0x68, 0x8c, 0x31, 0x66, 0x02, 0x92, 0xc6, 0x84, 0x91, 0x76, 0xc4, 0xc4, 0x7f,
+	0x9a, 0xa3, 0xdc, 0xe0, 0x02, 0xf4, 0xb0, 0x77, 0xa0, 0x59, 0x7c, 0x11, 0xbe, 0x32, 0x5f, 0x93,
+	0xb9, 0xde, 0x55, 0x3a, 0x1c, 0xff, 0xdd, 0xf3, 0x7d, 0x7e, 0xf0, 0x79, 0x1e, 0xbe, 0x00, 0x16,
+	0xb9, 0x1d, 0xaf, 0xe6, 0xb4, 0xb5, 0x4a, 0x98, 0x60, 0xa8, 0xa4, 0xa3, 0xcd, 0xb9, 0x7b, 0x05,
+	0xe5, 0x80, 0x4e, 0x63, 0x9f, 0x7c, 0x5f, 0x13, 0x2e, 0x90, 0x0d, 0x66, 0xc4, 0x13, 0xc7, 0x68,
+	0x18, 0x4d, 0xcb, 0x97, 0x4f, 0xe4, 0xc0, 0xc3, 0x55, 0xc2, 0x6e, 0xe8, 0x82, 0x38, 0x07, 0x0d,
+	0xa3, 0x59, 0xf2, 0xb3, 0x10, 0x3d, 0x82, 0x43, 0xc1, 0xe6, 0x24, 0x76, 0xcc, 0x54, 0x57, 0x81,
+	0xdb, 0x00, 0xcb, 0x27, 0x31, 0xf9, 0xb1, 0x77, 0xa2, 0xfb, 0xdb, 0x00, 0x4b, 0x7d, 0x26, 0x5f,
+	0xb1, 0x98, 0x13, 0x74, 0x06, 0x45, 0x2e, 0xb0, 0x58, 0xf3, 0xb4, 0xaa, 0x72, 0x51, 0x6d, 0xfd,
+	0xe3, 0x6b, 0x05, 0x69, 0xc2, 0xd7, 0x05, 0xa8, 0x01, 0xe5, 0x88, 0x24, 0x82, 0xde, 0xd0, 0x08,
+	0x0b, 0x45, 0x64, 0xf9, 0x79, 0x49, 0x52, 0x45, 0x33, 0x4c, 0x25, 0x95, 0xd9, 0xb4, 0x7c, 0x15,
+	0xa0, 0x67, 0x00, 0x89, 0x02, 0x0a, 0xe9, 0xc4, 0x29, 0xa4, 0xc0, 0x25, 0xad, 0x78, 0x13, 0xf7,
+	0x23, 0x1c, 0xfb, 0x64, 0xc3, 0xe6, 0x24, 0xa3, 0xae, 0x41, 0x91, 0x93, 0x84, 0xe2, 0x45, 0x8a,
+	0x54, 0xf2, 0x75, 0x24, 0xf5, 0x84, 0x60, 0xce, 0x62, 0x7d, 0x0c, 0x1d, 0xb9, 0x7d, 0xa8, 0x64,
+	0x03, 0xf4, 0x52, 0xfb, 0x26, 0xa4, 0x24, 0xb2, 0x72, 0x12, 0x62, 0x91, 0x4e, 0x31, 0xfd, 0x92,
+	0x56, 0x2e, 0x85, 0x5b, 0x85, 0x93, 0x3e, 0x11, 0x1d, 0x09, 0xad, 0x59, 0xdc, 0x37, 0x60, 0x6f,
+	0x25, 0x3d, 0xdd, 0x05, 0x2b, 0xb7, 0xb4, 0x3c, 0x9c, 0x5c, 0xf6, 0x8e, 0xe6, 0x76, 0xe1, 0xf4,
+	0x2b, 0x16, 0xd1, 0x4c, 0x82, 0x45, 0x58, 0x50, 0x16, 0xf3, 0x6c, 0xbd, 0x33, 0xb0, 0x69, 0x1c,
+	0x2d, 0xd6, 0x13, 0x12, 0x92, 0x9f, 0x94, 0x0b, 0x1a, 0x4f, 0x53, 0xcc, 0x23, 0xff, 0x44, 0xeb,
+	0x3d, 0x2d, 0xbb, 0xbf, 0x00, 0xb6, 0x03, 0xf6, 0x6e, 0xf5, 0x1c, 0xca, 0x11, 0x5b, 0x2e, 0x59,
+	0x1c, 0xc6, 0x78, 0x99, 0x39, 0x05, 0x94, 0x34, 0xc0, 0x4b, 0xb2, 0xb3, 0xb6, 0xb9, 0xb3, 0x76,
+	0xee, 0xae, 0x85, 0xfc, 0x5d, 0x5f, 0xf4, 0xa1, 0xa8, 0x1c, 0x80, 0x6a, 0x80, 0x82, 0xeb, 0xcb,
+	0xeb, 0x51, 0x10, 0x8e, 0x06, 0xc1, 0xb0, 0xd7, 0xf1, 0x3e, 0x7b, 0xbd, 0xae, 0xfd, 0x00, 0x55,
+	0xe1, 0x58, 0xeb, 0x5e, 0x10, 0x8c, 0x7a, 0x5d, 0xdb, 0x40, 0x08, 0x2a, 0x5a, 0x1a, 0xf6, 0x06,
+	0x5d, 0x6f, 0xd0, 0xb7, 0x0f, 0x2e, 0xfe, 0x1c, 0x80, 0x39, 0xfc, 0xe2, 0xa1, 0xb7, 0x50, 0x90,
+	0xde, 0x43, 0xb5, 0xbc, 0xc7, 0xb6, 0x3f, 0x80, 0xfa, 0xe9, 0x7f, 0xba, 0xbe, 0xf8, 0x3b, 0x38,
+	0x4c, 0x7d, 0x8d, 0xf2, 0x15, 0x79, 0xa7, 0xef, 0x6f, 0xfd, 0x00, 0x45, 0x65, 0x0e, 0xe4, 0xdc,
+	0xe9, 0xcd, 0x19, 0xae, 0xfe, 0xe4, 0x9e, 0x8c, 0x6e, 0xef, 0xc0, 0x51, 0xf6, 0xfd, 0xa3, 0x7a,
+	0xae, 0x6c, 0xc7, 0x27, 0xf5, 0xa7, 0xf7, 0xe6, 0xf4, 0x90, 0x2b, 0xb0, 0x77, 0xcd, 0x80, 0xdc,
+	0x5c, 0xc3, 0x1e, 0xa7, 0xd4, 0x1f, 0xef, 0x70, 0xa9, 0xf4, 0x2b, 0xe3, 0x53, 0xfb, 0xdb, 0xcb,
+	0x29, 0x15, 0xb3, 0xf5, 0xb8, 0x15, 0xb1, 0x65, 0x9b, 0xdc, 0x8e, 0x31, 0x97, 0x19, 0xf9, 0x0a,
+	0x57, 0x73, 0xda, 0x56, 0x6d, 0xed, 0xcd, 0xf9, 0x7b, 0xf5, 0x1a, 0x17, 0xd3, 0xff, 0x9e, 0xd7,
+	0x7f, 0x07, 0x00, 0xb0, 0xbe, 0x24, 0xd9, 0x8b, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConnInterface
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion6
+
+// PKIClient is the client API for PKI service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type PKIClient interface {
+	// Sign a CSR. While waiting for approval the response is PENDING, call
+	// Sign again with the same CSR to poll.
+	Sign(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error)
+	// Renew the TLS client certificate, the CSR must keep the same names.
+	Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*SignResponse, error)
+	// Revoke the TLS client certificate, or any certificate for callers
+	// allowed to use the management API.
+	Revoke(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeResponse, error)
+	// GetChain return the CA certificates.
+	GetChain(ctx context.Context, in *GetChainRequest, opts ...grpc.CallOption) (*GetChainResponse, error)
+	// WatchRevocations stream the revoked certificates as they are revoked.
+	WatchRevocations(ctx context.Context, in *WatchRevocationsRequest, opts ...grpc.CallOption) (PKI_WatchRevocationsClient, error)
+}
+
+type pKIClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPKIClient(cc grpc.ClientConnInterface) PKIClient {
+	return &pKIClient{cc}
+}
+
+func (c *pKIClient) Sign(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, "/ezbpki.v1.PKI/Sign", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIClient) Renew(ctx context.Context, in *RenewRequest, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, "/ezbpki.v1.PKI/Renew", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIClient) Revoke(ctx context.Context, in *RevokeRequest, opts ...grpc.CallOption) (*RevokeResponse, error) {
+	out := new(RevokeResponse)
+	err := c.cc.Invoke(ctx, "/ezbpki.v1.PKI/Revoke", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIClient) GetChain(ctx context.Context, in *GetChainRequest, opts ...grpc.CallOption) (*GetChainResponse, error) {
+	out := new(GetChainResponse)
+	err := c.cc.Invoke(ctx, "/ezbpki.v1.PKI/GetChain", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *pKIClient) WatchRevocations(ctx context.Context, in *WatchRevocationsRequest, opts ...grpc.CallOption) (PKI_WatchRevocationsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_PKI_serviceDesc.Streams[0], "/ezbpki.v1.PKI/WatchRevocations", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &pKIWatchRevocationsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PKI_WatchRevocationsClient interface {
+	Recv() (*Revocation, error)
+	grpc.ClientStream
+}
+
+type pKIWatchRevocationsClient struct {
+	grpc.ClientStream
+}
+
+func (x *pKIWatchRevocationsClient) Recv() (*Revocation, error) {
+	m := new(Revocation)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PKIServer is the server API for PKI service.
+type PKIServer interface {
+	// Sign a CSR. While waiting for approval the response is PENDING, call
+	// Sign again with the same CSR to poll.
+	Sign(context.Context, *SignRequest) (*SignResponse, error)
+	// Renew the TLS client certificate, the CSR must keep the same names.
+	Renew(context.Context, *RenewRequest) (*SignResponse, error)
+	// Revoke the TLS client certificate, or any certificate for callers
+	// allowed to use the management API.
+	Revoke(context.Context, *RevokeRequest) (*RevokeResponse, error)
+	// GetChain return the CA certificates.
+	GetChain(context.Context, *GetChainRequest) (*GetChainResponse, error)
+	// WatchRevocations stream the revoked certificates as they are revoked.
+	WatchRevocations(*WatchRevocationsRequest, PKI_WatchRevocationsServer) error
+}
+
+// UnimplementedPKIServer can be embedded to have forward compatible implementations.
+type UnimplementedPKIServer struct {
+}
+
+func (*UnimplementedPKIServer) Sign(ctx context.Context, req *SignRequest) (*SignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sign not implemented")
+}
+func (*UnimplementedPKIServer) Renew(ctx context.Context, req *RenewRequest) (*SignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Renew not implemented")
+}
+func (*UnimplementedPKIServer) Revoke(ctx context.Context, req *RevokeRequest) (*RevokeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Revoke not implemented")
+}
+func (*UnimplementedPKIServer) GetChain(ctx context.Context, req *GetChainRequest) (*GetChainResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChain not implemented")
+}
+func (*UnimplementedPKIServer) WatchRevocations(req *WatchRevocationsRequest, srv PKI_WatchRevocationsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRevocations not implemented")
+}
+
+func RegisterPKIServer(s *grpc.Server, srv PKIServer) {
+	s.RegisterService(&_PKI_serviceDesc, srv)
+}
+
+func _PKI_Sign_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIServer).Sign(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ezbpki.v1.PKI/Sign",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIServer).Sign(ctx, req.(*SignRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKI_Renew_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenewRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIServer).Renew(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ezbpki.v1.PKI/Renew",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIServer).Renew(ctx, req.(*RenewRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKI_Revoke_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIServer).Revoke(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ezbpki.v1.PKI/Revoke",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIServer).Revoke(ctx, req.(*RevokeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKI_GetChain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetChainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PKIServer).GetChain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/ezbpki.v1.PKI/GetChain",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PKIServer).GetChain(ctx, req.(*GetChainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PKI_WatchRevocations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRevocationsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PKIServer).WatchRevocations(m, &pKIWatchRevocationsServer{stream})
+}
+
+type PKI_WatchRevocationsServer interface {
+	Send(*Revocation) error
+	grpc.ServerStream
+}
+
+type pKIWatchRevocationsServer struct {
+	grpc.ServerStream
+}
+
+func (x *pKIWatchRevocationsServer) Send(m *Revocation) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _PKI_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "ezbpki.v1.PKI",
+	HandlerType: (*PKIServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Sign",
+			Handler:    _PKI_Sign_Handler,
+		},
+		{
+			MethodName: "Renew",
+			Handler:    _PKI_Renew_Handler,
+		},
+		{
+			MethodName: "Revoke",
+			Handler:    _PKI_Revoke_Handler,
+		},
+		{
+			MethodName: "GetChain",
+			Handler:    _PKI_GetChain_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRevocations",
+			Handler:       _PKI_WatchRevocations_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "ezbpki.proto",
+}
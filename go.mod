@@ -4,8 +4,14 @@ go 1.13
 
 require (
 	github.com/ShowMax/go-fqdn v0.0.0-20180501083314-6f60894d629f
+	github.com/ThalesIgnite/crypto11 v1.2.5
 	github.com/ezbastion/ezb_lib v0.1.0
+	github.com/golang/protobuf v1.3.5
 	github.com/sirupsen/logrus v1.4.2
 	github.com/urfave/cli v1.22.2
+	go.etcd.io/bbolt v1.3.4
+	go.mozilla.org/pkcs7 v0.10.0
+	golang.org/x/crypto v0.0.0-20200220183623-bac4c82f6975
 	golang.org/x/sys v0.0.0-20200219091948-cb0a6d8edb6c
+	google.golang.org/grpc v1.27.1
 )
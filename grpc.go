@@ -0,0 +1,241 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	ezbpki "github.com/ezbastion/ezb_pki/ezbpki/v1"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// revocationPoll is how often WatchRevocations look for new revocations,
+// they may be made by the cli in another process.
+const revocationPoll = 5 * time.Second
+
+// startGRPCServer serve the ezbpki.v1 service over TLS on conf.GRPC.Listen
+// until stop is closed.
+func startGRPCServer(rca *rootCA, stop <-chan bool) {
+	if conf.GRPC.Listen == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", conf.GRPC.Listen)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(rca.tlsConfig())))
+	ezbpki.RegisterPKIServer(srv, &pkiServer{rca: rca})
+	go func() {
+		<-stop
+		srv.Stop()
+	}()
+	log.Println("gRPC listen at ", conf.GRPC.Listen)
+	if err := srv.Serve(listener); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// pkiServer implement ezbpki.PKIServer on top of the issuance core shared
+// with the signing port.
+type pkiServer struct {
+	rca *rootCA
+}
+
+// grpcPeer return the verified client certificate, if any, and the client
+// address.
+func grpcPeer(ctx context.Context) (*x509.Certificate, string) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, "grpc:" + p.Addr.String()
+	}
+	return info.State.PeerCertificates[0], "grpc:" + p.Addr.String()
+}
+
+// grpcError translate enrollment errors to gRPC status, internal errors
+// are logged and not detailed.
+func grpcError(err error) error {
+	perr, ok := err.(*protocol.Error)
+	if !ok {
+		log.Errorln(err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	code := codes.Internal
+	switch perr.Code {
+	case protocol.CodeMalformed, protocol.CodeBadCSR:
+		code = codes.InvalidArgument
+	case protocol.CodeUnauthorized:
+		code = codes.Unauthenticated
+	case protocol.CodeRefused, protocol.CodeRejected:
+		code = codes.PermissionDenied
+	case protocol.CodeNotFound:
+		code = codes.NotFound
+	}
+	return status.Error(code, perr.Message)
+}
+
+func (s *pkiServer) signResponse(cert *x509.Certificate, queued *models.Request) *ezbpki.SignResponse {
+	if cert == nil {
+		return &ezbpki.SignResponse{Status: ezbpki.Status_STATUS_PENDING, RequestId: queued.ID}
+	}
+	log.Println("Transmitted client Certificate to ", cert.Subject.CommonName, " over gRPC")
+	return &ezbpki.SignResponse{
+		Status:      ezbpki.Status_STATUS_ISSUED,
+		Certificate: cert.Raw,
+		Chain:       s.rca.chain,
+	}
+}
+
+func (s *pkiServer) Sign(ctx context.Context, req *ezbpki.SignRequest) (*ezbpki.SignResponse, error) {
+	csr, err := x509.ParseCertificateRequest(req.Csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	peer, requester := grpcPeer(ctx)
+	cert, queued, err := s.rca.enroll(&enrollment{
+		csr:       csr,
+		profile:   req.Profile,
+		token:     req.Token,
+		requester: requester,
+		peer:      peer,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return s.signResponse(cert, queued), nil
+}
+
+func (s *pkiServer) Renew(ctx context.Context, req *ezbpki.RenewRequest) (*ezbpki.SignResponse, error) {
+	peer, requester := grpcPeer(ctx)
+	if peer == nil {
+		return nil, status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	csr, err := x509.ParseCertificateRequest(req.Csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	cert, queued, err := s.rca.enroll(&enrollment{
+		csr:       csr,
+		requester: requester,
+		peer:      peer,
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return s.signResponse(cert, queued), nil
+}
+
+// Revoke let a node revoke its own certificate, and API callers any.
+func (s *pkiServer) Revoke(ctx context.Context, req *ezbpki.RevokeRequest) (*ezbpki.RevokeResponse, error) {
+	peer, _ := grpcPeer(ctx)
+	if peer == nil {
+		return nil, status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	key, err := normalizeSerial(req.Serial)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	reason := ca.ReasonUnspecified
+	if req.Reason != "" {
+		if reason, err = ca.ParseReason(req.Reason); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	if key != db.SerialKey(peer.SerialNumber) {
+		if err := s.rca.authorizeAdmin(peer); err != nil {
+			return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+		}
+	}
+
+	err = s.rca.revoke(key, reason, "gRPC: "+peer.Subject.CommonName)
+	if err == db.ErrNotFound {
+		return nil, status.Errorf(codes.NotFound, "unknown certificate %s", key)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+	rec, err := s.rca.store.Certificate(key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ezbpki.RevokeResponse{Serial: key, RevokedAt: rec.RevokedAt.Unix()}, nil
+}
+
+func (s *pkiServer) GetChain(ctx context.Context, req *ezbpki.GetChainRequest) (*ezbpki.GetChainResponse, error) {
+	return &ezbpki.GetChainResponse{Certificates: s.rca.chain}, nil
+}
+
+// WatchRevocations send the revoked certificates not yet expired, the
+// current ones only when asked, until the client goes away.
+func (s *pkiServer) WatchRevocations(req *ezbpki.WatchRevocationsRequest, stream ezbpki.PKI_WatchRevocationsServer) error {
+	sent := make(map[string]bool)
+	first := true
+	var last uint64
+	ticker := time.NewTicker(revocationPoll)
+	defer ticker.Stop()
+	for {
+		revocations, err := s.rca.store.Revocations()
+		if err != nil {
+			return grpcError(err)
+		}
+		if first || revocations != last {
+			list, err := s.rca.store.RevokedCertificates(time.Now())
+			if err != nil {
+				return grpcError(err)
+			}
+			for _, rec := range list {
+				if sent[rec.Serial] {
+					continue
+				}
+				sent[rec.Serial] = true
+				if first && !req.IncludeExisting {
+					continue
+				}
+				err = stream.Send(&ezbpki.Revocation{
+					Serial:     rec.Serial,
+					CommonName: rec.CommonName,
+					RevokedAt:  rec.RevokedAt.Unix(),
+					Reason:     ca.ReasonString(rec.RevocationReason),
+				})
+				if err != nil {
+					return err
+				}
+			}
+			first, last = false, revocations
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
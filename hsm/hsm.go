@@ -0,0 +1,50 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package hsm keep the CA key in a PKCS#11 token. The PKCS#11 support
+// needs cgo and is only built with the pkcs11 build tag:
+//
+//	go build -tags pkcs11
+package hsm
+
+import (
+	"crypto"
+	"errors"
+)
+
+// ErrNotSupported is returned by Open when ezb_pki is built without the
+// pkcs11 tag.
+var ErrNotSupported = errors.New("ezb_pki is built without PKCS#11 support, rebuild with -tags pkcs11")
+
+// Config select the token and log in.
+type Config struct {
+	// Module is the path of the PKCS#11 library, such as softhsm2.dll.
+	Module string
+	// Slot or TokenLabel select the token.
+	Slot       *int
+	TokenLabel string
+	PIN        string
+}
+
+// Token is an open session pool on a PKCS#11 token, close it once its
+// keys are not used anymore.
+type Token interface {
+	// FindKey return the key pair labelled label.
+	FindKey(label string) (crypto.Signer, error)
+	// GenerateKey create a key pair of keyType, p256, p384, p521, rsa2048,
+	// rsa3072 or rsa4096, labelled label.
+	GenerateKey(label string, keyType string) (crypto.Signer, error)
+	Close() error
+}
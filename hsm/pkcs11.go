@@ -0,0 +1,92 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build pkcs11
+// +build pkcs11
+
+package hsm
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"strings"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+type token struct {
+	ctx *crypto11.Context
+}
+
+// Open log in the token described by conf.
+func Open(conf Config) (Token, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       conf.Module,
+		SlotNumber: conf.Slot,
+		TokenLabel: conf.TokenLabel,
+		Pin:        conf.PIN,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 token: %v", err)
+	}
+	return &token{ctx: ctx}, nil
+}
+
+func (t *token) FindKey(label string) (crypto.Signer, error) {
+	key, err := t.ctx.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 token: %v", err)
+	}
+	if key == nil {
+		return nil, fmt.Errorf("PKCS#11 token: no key pair labelled %q", label)
+	}
+	return key, nil
+}
+
+func (t *token) GenerateKey(label string, keyType string) (crypto.Signer, error) {
+	// the id only has to be unique in the token, the key is found by label.
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	var key crypto11.Signer
+	var err error
+	switch strings.ToLower(keyType) {
+	case "", "p256":
+		key, err = t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P256())
+	case "p384":
+		key, err = t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P384())
+	case "p521":
+		key, err = t.ctx.GenerateECDSAKeyPairWithLabel(id, []byte(label), elliptic.P521())
+	case "rsa2048":
+		key, err = t.ctx.GenerateRSAKeyPairWithLabel(id, []byte(label), 2048)
+	case "rsa3072":
+		key, err = t.ctx.GenerateRSAKeyPairWithLabel(id, []byte(label), 3072)
+	case "rsa4096":
+		key, err = t.ctx.GenerateRSAKeyPairWithLabel(id, []byte(label), 4096)
+	default:
+		return nil, fmt.Errorf("key type %q is not supported on PKCS#11 tokens", keyType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 token: %v", err)
+	}
+	return key, nil
+}
+
+func (t *token) Close() error {
+	return t.ctx.Close()
+}
@@ -0,0 +1,176 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build pkcs11
+// +build pkcs11
+
+package hsm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+const testPIN = "1234"
+
+// softHSMModules are the usual paths of the SoftHSM v2 library,
+// SOFTHSM2_MODULE overrides them.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	`C:\SoftHSM2\lib\softhsm2-x64.dll`,
+}
+
+// softHSM initialize a new token in the SoftHSM of SOFTHSM2_CONF and
+// return its configuration and a function deleting it. The test is
+// skipped without SoftHSM.
+func softHSM(t *testing.T) (Config, func()) {
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF is not set")
+	}
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			module = path
+		}
+	}
+	if module == "" {
+		t.Skip("libsofthsm2 not found, set SOFTHSM2_MODULE")
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+	label := fmt.Sprintf("ezb-pki-test-%d", time.Now().UnixNano())
+	out, err := exec.Command(util, "--init-token", "--free", "--label", label, "--pin", testPIN, "--so-pin", testPIN).CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util --init-token: %v\n%s", err, out)
+	}
+	return Config{Module: module, TokenLabel: label, PIN: testPIN}, func() {
+		exec.Command(util, "--delete-token", "--token", label).Run()
+	}
+}
+
+func publicDER(t *testing.T, key crypto.Signer) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// signChain self-sign a CA certificate with key, sign a leaf with it and
+// verify the leaf.
+func signChain(t *testing.T, key crypto.Signer) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ezb_pki HSM test CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSoftHSM(t *testing.T) {
+	conf, cleanup := softHSM(t)
+	defer cleanup()
+
+	token, err := Open(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+
+	for _, keyType := range []string{"p256", "P384", "rsa2048"} {
+		t.Run(keyType, func(t *testing.T) {
+			label := "ca-" + keyType
+			if _, err := token.FindKey(label); err == nil {
+				t.Fatalf("key pair %s found before it is generated", label)
+			}
+			key, err := token.GenerateKey(label, keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, err := token.FindKey(label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(publicDER(t, key), publicDER(t, found)) {
+				t.Error("FindKey returned another key pair")
+			}
+			signChain(t, found)
+		})
+	}
+
+	if _, err := token.GenerateKey("ca-dsa", "dsa1024"); err == nil {
+		t.Error("unsupported key type accepted")
+	}
+}
+
+func TestSoftHSMBadPIN(t *testing.T) {
+	conf, cleanup := softHSM(t)
+	defer cleanup()
+
+	conf.PIN = "0000"
+	if token, err := Open(conf); err == nil {
+		token.Close()
+		t.Fatal("logged in with a wrong PIN")
+	}
+}
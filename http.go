@@ -0,0 +1,72 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startHTTPServer serve the CA certificate, trust bundle, CRL, OCSP,
+// request polling, SCEP and metrics endpoints on conf.HTTPListen until stop is closed.
+func startHTTPServer(rca *rootCA, stop <-chan bool) {
+	if conf.HTTPListen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/crl", rca.crl)
+	mux.Handle("/"+conf.ServiceName+".crl", rca.crl)
+	if rca.previousCRL != nil {
+		mux.Handle("/previous.crl", rca.previousCRL)
+		mux.Handle("/"+conf.ServiceName+"-previous.crl", rca.previousCRL)
+	}
+	mux.Handle("/ocsp", rca.ocsp)
+	mux.Handle("/ocsp/", rca.ocsp)
+	mux.HandleFunc("/csr/", rca.serveRequest)
+	if conf.SCEP.Enabled {
+		mux.Handle("/scep", rca.scep)
+		mux.Handle("/scep/", rca.scep)
+	}
+	if conf.Metrics {
+		mux.HandleFunc("/metrics", rca.serveMetrics)
+	}
+	mux.HandleFunc("/ca.crt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(rca.cert.Raw)
+	})
+	mux.HandleFunc("/root.crt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(rca.chain[len(rca.chain)-1])
+	})
+	mux.HandleFunc("/bundle.crt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		for _, der := range rca.bundle {
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+	})
+
+	srv := &http.Server{Addr: conf.HTTPListen, Handler: mux}
+	go func() {
+		<-stop
+		srv.Close()
+	}()
+	log.Println("HTTP listen at ", conf.HTTPListen)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorln(err)
+	}
+}
@@ -0,0 +1,50 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/urfave/cli"
+)
+
+func listCertificates(c *cli.Context) error {
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+	var list []models.Certificate
+	if cn := c.String("cn"); cn != "" {
+		list, err = store.CertificatesByCommonName(cn)
+	} else {
+		list, err = store.Certificates(nil)
+	}
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tCOMMON NAME\tSTATUS\tNOT AFTER\tREQUESTER\tRENEWED BY")
+	for _, rec := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", rec.Serial, rec.CommonName, rec.CurrentStatus(now), rec.NotAfter.Format(time.RFC3339), rec.Requester, rec.RenewedBy)
+	}
+	return w.Flush()
+}
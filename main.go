@@ -21,7 +21,11 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
 	"github.com/ezbastion/ezb_pki/setup"
 
 	"github.com/urfave/cli"
@@ -49,10 +53,253 @@ func main() {
 		{
 			Name:  "init",
 			Usage: "Genarate config file and root CA certificat.",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "intermediates",
+					Usage: "number of intermediate CAs below an offline root, the last one signs the nodes certificates",
+				},
+				cli.StringFlag{
+					Name:  "root-cert",
+					Usage: "PEM certificate of an existing root signing the intermediates",
+				},
+				cli.StringFlag{
+					Name:  "root-key",
+					Usage: "PEM private key of the existing root",
+				},
+				cli.StringFlag{
+					Name:  "key-type",
+					Value: "p256",
+					Usage: "CA key algorithm, one of " + strings.Join(setup.KeyTypes, ", "),
+				},
+				cli.BoolFlag{
+					Name:  "csr",
+					Usage: "create the CA key and a certificate request for an external CA",
+				},
+				cli.StringFlag{
+					Name:  "import",
+					Usage: "PEM or PKCS#12 file with the CA certificate issued by an external CA, its chain and key",
+				},
+				cli.StringFlag{
+					Name:  "import-key",
+					Usage: "PEM private key of the imported CA certificate, when not in the --import file",
+				},
+				cli.BoolFlag{
+					Name:  "external-ca",
+					Usage: "like --csr, the certificate is installed with ca install-cert once chained to --trust-anchor",
+				},
+				cli.StringFlag{
+					Name:  "trust-anchor",
+					Usage: "PEM certificates of the parent PKI roots, required with --external-ca",
+				},
+				cli.BoolFlag{
+					Name:  "unencrypted",
+					Usage: "store the CA keys without passphrase",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				err := setup.Setup()
+				if (c.String("root-cert") == "") != (c.String("root-key") == "") {
+					return cli.NewExitError("--root-cert and --root-key go together", -1)
+				}
+				modes := 0
+				for _, set := range []bool{c.Bool("csr"), c.String("import") != "", c.Bool("external-ca"), c.Int("intermediates") > 0 || c.String("root-cert") != ""} {
+					if set {
+						modes++
+					}
+				}
+				if modes > 1 {
+					return cli.NewExitError("--csr, --import, --external-ca and --intermediates/--root-cert exclude each other", -1)
+				}
+				err := setup.Setup(setup.Options{
+					Intermediates: c.Int("intermediates"),
+					RootCert:      c.String("root-cert"),
+					RootKey:       c.String("root-key"),
+					KeyType:       c.String("key-type"),
+					CSR:           c.Bool("csr"),
+					Import:        c.String("import"),
+					ImportKey:     c.String("import-key"),
+					ExternalCA:    c.Bool("external-ca"),
+					TrustAnchor:   c.String("trust-anchor"),
+					Unencrypted:   c.Bool("unencrypted"),
+				})
 				return err
 			},
+		}, {
+			Name:  "list",
+			Usage: "List issued certificates.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "cn",
+					Usage: "only certificates issued to this common name",
+				},
+			},
+			Action: listCertificates,
+		}, {
+			Name:  "revoke",
+			Usage: "Revoke certificates by serial or common name.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "serial",
+					Usage: "hexadecimal serial number of the certificate",
+				},
+				cli.StringFlag{
+					Name:  "cn",
+					Usage: "revoke every valid certificate issued to this common name",
+				},
+				cli.StringFlag{
+					Name:  "reason",
+					Value: "unspecified",
+					Usage: "RFC 5280 reason: " + strings.Join(ca.ReasonNames(), ", "),
+				},
+			},
+			Action: revokeCertificate,
+		}, {
+			Name:  "token",
+			Usage: "Manage enrollment tokens.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "create",
+					Usage: "Create a one-time enrollment token for a node.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "cn",
+							Usage: "common name the node must request",
+						},
+						cli.StringSliceFlag{
+							Name:  "dns",
+							Usage: "DNS name the node may request, repeatable",
+						},
+						cli.StringSliceFlag{
+							Name:  "ip",
+							Usage: "IP address the node may request, repeatable",
+						},
+						cli.StringFlag{
+							Name:  "profile",
+							Usage: "profile issued whatever the request asks, required for the API profiles",
+						},
+						cli.DurationFlag{
+							Name:  "ttl",
+							Value: 24 * time.Hour,
+							Usage: "token lifetime",
+						},
+					},
+					Action: createToken,
+				}, {
+					Name:   "list",
+					Usage:  "List enrollment tokens.",
+					Action: listTokens,
+				},
+			},
+		}, {
+			Name:  "csr",
+			Usage: "Manage certificate requests waiting for approval.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List pending requests.",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "include decided requests",
+						},
+					},
+					Action: listRequests,
+				}, {
+					Name:      "approve",
+					Usage:     "Approve a pending request.",
+					ArgsUsage: "<id>",
+					Action: func(c *cli.Context) error {
+						return decideRequest(c, models.RequestApproved)
+					},
+				}, {
+					Name:      "reject",
+					Usage:     "Reject a pending request.",
+					ArgsUsage: "<id>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "reason",
+							Usage: "reason given to the node",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return decideRequest(c, models.RequestRejected)
+					},
+				},
+			},
+		}, {
+			Name:  "ca",
+			Usage: "Manage the CA key.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "rollover",
+					Usage: "Replace the root with a new key, cross-signed with the current one.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "key-type",
+							Usage: "new key algorithm, one of " + strings.Join(setup.KeyTypes, ", ") + ", the current one when empty",
+						},
+						cli.StringFlag{
+							Name:  "transition",
+							Value: "90d",
+							Usage: "time both roots are served, a duration or a number of days",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						conf, err := setup.CheckConfig()
+						if err != nil {
+							return cli.NewExitError(err, -1)
+						}
+						transition, err := ca.ParseValidity(c.String("transition"))
+						if err != nil {
+							return cli.NewExitError(err, -1)
+						}
+						return setup.StartRollover(conf, c.String("key-type"), transition)
+					},
+				}, {
+					Name:      "install-cert",
+					Usage:     "Install the CA certificate signed by the parent CA for init --external-ca.",
+					ArgsUsage: "<PEM or PKCS#12 file with the certificate and its chain>",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "trust-anchor",
+							Usage: "PEM certificates the chain must reach, the configured trustanchor when empty",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if c.NArg() != 1 {
+							return cli.NewExitError("the signed certificate file is required", -1)
+						}
+						conf, err := setup.CheckConfig()
+						if err != nil {
+							return cli.NewExitError(err, -1)
+						}
+						if err = setup.InstallCert(conf, c.Args().First(), c.String("trust-anchor")); err != nil {
+							return cli.NewExitError(err, -1)
+						}
+						return nil
+					},
+				},
+			},
+		}, {
+			Name:  "rekey-passphrase",
+			Usage: "Change the passphrase encrypting a CA private key.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Value: "ca",
+					Usage: "key to re-encrypt, cert/<servicename>-<key>.key",
+				},
+				cli.BoolFlag{
+					Name:  "unencrypted",
+					Usage: "store the key without passphrase",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				conf, err := setup.CheckConfig()
+				if err != nil {
+					return cli.NewExitError(err, -1)
+				}
+				return setup.RekeyPassphrase(conf, c.String("key"), c.Bool("unencrypted"))
+			},
 		}, {
 			Name:  "debug",
 			Usage: "Start pki deamon .",
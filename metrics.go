@@ -0,0 +1,142 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// renewalBuckets are the upper bounds, in seconds, of the remaining
+// lifetime histogram: from a minute to 30 days.
+var renewalBuckets = []float64{60, 300, 900, 3600, 4 * 3600, 12 * 3600, 24 * 3600, 7 * 24 * 3600, 30 * 24 * 3600}
+
+// histogram count observations in renewalBuckets.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// metrics count issuance and renewals by profile, served at /metrics in
+// the Prometheus text format.
+type metrics struct {
+	mu        sync.Mutex
+	issued    map[string]uint64
+	remaining map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{issued: map[string]uint64{}, remaining: map[string]*histogram{}}
+}
+
+func (m *metrics) issue(profile string) {
+	m.mu.Lock()
+	m.issued[profile]++
+	m.mu.Unlock()
+}
+
+// renew observe the lifetime left to the replaced certificate, the
+// renewal lag: the closer to zero, the closer nodes renew to expiry.
+func (m *metrics) renew(profile string, remaining time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.remaining[profile]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(renewalBuckets))}
+		m.remaining[profile] = h
+	}
+	s := remaining.Seconds()
+	for i, bound := range renewalBuckets {
+		if s <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// overdue count by profile the valid certificates with less than a third
+// of their lifetime left and not renewed yet.
+func overdue(list []models.Certificate, now time.Time) map[string]uint64 {
+	counts := map[string]uint64{}
+	for _, rec := range list {
+		if rec.RenewedBy != "" || rec.CurrentStatus(now) != models.StatusValid {
+			continue
+		}
+		if rec.NotAfter.Sub(now) < rec.NotAfter.Sub(rec.NotBefore)/3 {
+			counts[rec.Profile]++
+		}
+	}
+	return counts
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (rca *rootCA) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	list, err := rca.store.Certificates(nil)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, "inventory not available", http.StatusServiceUnavailable)
+		return
+	}
+	late := overdue(list, time.Now())
+
+	m := rca.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP ezb_pki_certificates_issued_total Certificates issued since the service started.")
+	fmt.Fprintln(w, "# TYPE ezb_pki_certificates_issued_total counter")
+	for _, profile := range sortedKeys(m.issued) {
+		fmt.Fprintf(w, "ezb_pki_certificates_issued_total{profile=%q} %d\n", profile, m.issued[profile])
+	}
+	fmt.Fprintln(w, "# HELP ezb_pki_renewal_remaining_seconds Lifetime left to certificates when renewed.")
+	fmt.Fprintln(w, "# TYPE ezb_pki_renewal_remaining_seconds histogram")
+	profiles := make([]string, 0, len(m.remaining))
+	for profile := range m.remaining {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	for _, profile := range profiles {
+		h := m.remaining[profile]
+		for i, bound := range renewalBuckets {
+			fmt.Fprintf(w, "ezb_pki_renewal_remaining_seconds_bucket{profile=%q,le=%q} %d\n", profile, strconv.FormatFloat(bound, 'f', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "ezb_pki_renewal_remaining_seconds_bucket{profile=%q,le=\"+Inf\"} %d\n", profile, h.count)
+		fmt.Fprintf(w, "ezb_pki_renewal_remaining_seconds_sum{profile=%q} %g\n", profile, h.sum)
+		fmt.Fprintf(w, "ezb_pki_renewal_remaining_seconds_count{profile=%q} %d\n", profile, h.count)
+	}
+	fmt.Fprintln(w, "# HELP ezb_pki_certificates_overdue Valid certificates with less than a third of their lifetime left, not renewed.")
+	fmt.Fprintln(w, "# TYPE ezb_pki_certificates_overdue gauge")
+	for _, profile := range sortedKeys(late) {
+		fmt.Fprintf(w, "ezb_pki_certificates_overdue{profile=%q} %d\n", profile, late[profile])
+	}
+}
@@ -0,0 +1,61 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import "time"
+
+// Certificate status stored in the inventory.
+const (
+	StatusValid   = "valid"
+	StatusExpired = "expired"
+	StatusRevoked = "revoked"
+)
+
+// Certificate is the inventory record of an issued certificate.
+type Certificate struct {
+	Serial      string    `json:"serial"`
+	CommonName  string    `json:"commonname"`
+	Subject     string    `json:"subject"`
+	DNSNames    []string  `json:"dnsnames,omitempty"`
+	IPAddresses []string  `json:"ipaddresses,omitempty"`
+	Emails      []string  `json:"emails,omitempty"`
+	URIs        []string  `json:"uris,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	NotBefore   time.Time `json:"notbefore"`
+	NotAfter    time.Time `json:"notafter"`
+	Profile     string    `json:"profile,omitempty"`
+	Requester   string    `json:"requester"`
+	Status      string    `json:"status"`
+	IssuedAt    time.Time `json:"issuedat"`
+	Raw         []byte    `json:"raw"`
+
+	RevokedAt        time.Time `json:"revokedat,omitempty"`
+	RevocationReason int       `json:"revocationreason,omitempty"`
+
+	// Renews is the serial of the certificate this one replaced,
+	// RenewedBy the serial of its replacement, issued at RenewedAt.
+	Renews    string    `json:"renews,omitempty"`
+	RenewedBy string    `json:"renewedby,omitempty"`
+	RenewedAt time.Time `json:"renewedat,omitempty"`
+}
+
+// CurrentStatus return the record status, taking expiration into account.
+func (c *Certificate) CurrentStatus(now time.Time) string {
+	if c.Status == StatusValid && now.After(c.NotAfter) {
+		return StatusExpired
+	}
+	return c.Status
+}
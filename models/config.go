@@ -19,7 +19,132 @@ import "github.com/ezbastion/ezb_lib/confmanager"
 
 type Configuration struct {
 	Listen          string             `json:"listen"`
+	TLS             bool               `json:"tls"`
+	HTTPListen      string             `json:"httplisten"`
+	PublicURL       string             `json:"publicurl"`
 	ServiceName     string             `json:"servicename"`
 	ServiceFullName string             `json:"servicefullname"`
+	AutoEnrollment  bool               `json:"autoenrollment"`
+	Approval        bool               `json:"approval"`
+	Metrics         bool               `json:"metrics"`
 	Logger          confmanager.Logger `json:"logger"`
+	CRL             CRL                `json:"crl"`
+	OCSP            OCSP               `json:"ocsp"`
+	ACME            ACME               `json:"acme"`
+	EST             EST                `json:"est"`
+	SCEP            SCEP               `json:"scep"`
+	API             API                `json:"api"`
+	GRPC            GRPC               `json:"grpc"`
+	KeyPassphrase   KeyPassphrase      `json:"keypassphrase"`
+	HSM             HSM                `json:"hsm"`
+	Renewal         Renewal            `json:"renewal"`
+	TrustAnchor     string             `json:"trustanchor"`
+	Policy          Policy             `json:"policy"`
+	DefaultProfile  string             `json:"defaultprofile"`
+	Profiles        map[string]Profile `json:"profiles"`
+}
+
+// CRL publication settings, Interval in minutes and Validity in hours.
+type CRL struct {
+	Interval int `json:"interval"`
+	Validity int `json:"validity"`
+}
+
+// OCSP responder settings. Validity is the responses lifetime in hours,
+// Delegated sign them with an OCSP signing certificate instead of the CA key.
+type OCSP struct {
+	Validity  int  `json:"validity"`
+	Delegated bool `json:"delegated"`
+}
+
+// ACME server settings. Listen is the TLS address of the ACME server,
+// disabled when empty, and URL its public https url, from the host name
+// and the listen port when empty. Profile is used for every ACME
+// certificate, the default profile when empty. PreAuthorized names, or
+// domains when starting with a dot, are issued without challenge
+// validation.
+type ACME struct {
+	Listen        string   `json:"listen"`
+	URL           string   `json:"url"`
+	Profile       string   `json:"profile"`
+	PreAuthorized []string `json:"preauthorized"`
+}
+
+// EST server settings. Listen is the TLS address of the EST endpoints,
+// disabled when empty. Profile is used when the url has no label.
+type EST struct {
+	Listen  string `json:"listen"`
+	Profile string `json:"profile"`
+}
+
+// SCEP server settings, served at /scep of the http listener. Profile is
+// used for every SCEP certificate, the default profile when empty.
+type SCEP struct {
+	Enabled bool   `json:"enabled"`
+	Profile string `json:"profile"`
+}
+
+// API is the management API settings. Listen is its TLS address, disabled
+// when empty. Callers need a valid certificate of one of Profiles, admin
+// when empty.
+type API struct {
+	Listen   string   `json:"listen"`
+	Profiles []string `json:"profiles"`
+}
+
+// GRPC is the ezbpki.v1 gRPC service settings. Listen is its TLS address,
+// disabled when empty.
+type GRPC struct {
+	Listen string `json:"listen"`
+}
+
+// KeyPassphrase tell where the service read the encrypted CA key
+// passphrase when EZB_PKI_PASSPHRASE is not set: the first line of File,
+// or the key agent listening on the Agent unix socket.
+type KeyPassphrase struct {
+	File  string `json:"file"`
+	Agent string `json:"agent"`
+}
+
+// Renewal settings of certificates renewed with the current one.
+// RequireNewKey refuse renewals keeping the same key, RevokeAfter revoke
+// the superseded certificate that long after its renewal, a duration such
+// as 72h or 7d, never when empty.
+type Renewal struct {
+	RequireNewKey bool   `json:"requirenewkey"`
+	RevokeAfter   string `json:"revokeafter"`
+}
+
+// Policy check the subject and names of every node certificate. Require
+// lists the subject fields the request must fill, among C, O, OU, L and
+// ST, Override the fields forced whatever the request holds.
+type Policy struct {
+	CommonName NameRule            `json:"commonname"`
+	DNS        NameRule            `json:"dns"`
+	IP         NameRule            `json:"ip"`
+	URI        NameRule            `json:"uri"`
+	Email      NameRule            `json:"email"`
+	Require    []string            `json:"require,omitempty"`
+	Override   map[string][]string `json:"override,omitempty"`
+}
+
+// NameRule accept a name matching one of Allow, any when empty, and none
+// of Deny. Entries are regular expressions, domain suffixes when starting
+// with a dot, and networks in CIDR notation for IP addresses. Common
+// names, DNS names and email addresses match whatever their case.
+type NameRule struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// HSM keep the CA key in a PKCS#11 token instead of
+// cert/<servicename>-ca.key when Module, the PKCS#11 library path, is set.
+// Slot or TokenLabel select the token, Label the CA key pair. An empty PIN
+// is read from EZB_PKI_HSM_PIN or prompted.
+type HSM struct {
+	Module     string `json:"module"`
+	Slot       *int   `json:"slot,omitempty"`
+	TokenLabel string `json:"tokenlabel"`
+	Label      string `json:"label"`
+	PIN        string `json:"pin"`
 }
@@ -0,0 +1,51 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+// Profile define the certificates issued to a node role.
+// Validity is a duration such as 8760h or 365d, AllowedNames are regular
+// expressions every DNS and IP subject alternative name must match.
+// ShortLived certificates, valid 7 days at most, rely on expiry instead of
+// revocation. Backdate set NotBefore that long before issuance to absorb
+// clock skew, 5m by default for short-lived profiles.
+type Profile struct {
+	Validity     string      `json:"validity"`
+	KeyUsage     []string    `json:"keyusage"`
+	ExtKeyUsage  []string    `json:"extkeyusage"`
+	AllowedNames []string    `json:"allowednames,omitempty"`
+	Extensions   []Extension `json:"extensions,omitempty"`
+	ShortLived   bool        `json:"shortlived,omitempty"`
+	Backdate     string      `json:"backdate,omitempty"`
+}
+
+// Extension is added as is to the certificates, Value is the base64 DER
+// encoded extension value.
+type Extension struct {
+	OID      string `json:"oid"`
+	Critical bool   `json:"critical"`
+	Value    string `json:"value"`
+}
+
+// DefaultProfileName is used when a request does not select a profile and
+// the configuration has no defaultprofile.
+const DefaultProfileName = "default"
+
+// DefaultProfile is the profile of the releases without profiles.
+var DefaultProfile = Profile{
+	Validity:    "87600h",
+	KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+	ExtKeyUsage: []string{"clientAuth", "serverAuth"},
+}
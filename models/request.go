@@ -0,0 +1,46 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import "time"
+
+// Certificate request status in the approval queue.
+const (
+	RequestPending  = "pending"
+	RequestApproved = "approved"
+	RequestRejected = "rejected"
+	RequestIssued   = "issued"
+)
+
+// Request is a certificate request waiting for an operator decision.
+type Request struct {
+	ID          string    `json:"id"`
+	CSR         []byte    `json:"csr"`
+	CommonName  string    `json:"commonname"`
+	DNSNames    []string  `json:"dnsnames,omitempty"`
+	IPAddresses []string  `json:"ipaddresses,omitempty"`
+	Emails      []string  `json:"emails,omitempty"`
+	URIs        []string  `json:"uris,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	Requester   string    `json:"requester"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	Serial      string    `json:"serial,omitempty"`
+	CreatedAt   time.Time `json:"createdat"`
+	DecidedAt   time.Time `json:"decidedat,omitempty"`
+	// Transaction is the SCEP transaction id, polled with GetCertInitial.
+	Transaction string `json:"transaction,omitempty"`
+}
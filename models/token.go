@@ -0,0 +1,34 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package models
+
+import "time"
+
+// Token is a one-time enrollment secret bound to the names a node may
+// request, no URI nor email name, and optionally to a profile. Only the
+// SHA-256 of the secret is stored.
+type Token struct {
+	ID          string    `json:"id"`
+	Hash        string    `json:"hash"`
+	CommonName  string    `json:"commonname"`
+	DNSNames    []string  `json:"dnsnames,omitempty"`
+	IPAddresses []string  `json:"ipaddresses,omitempty"`
+	Profile     string    `json:"profile,omitempty"`
+	CreatedAt   time.Time `json:"createdat"`
+	ExpiresAt   time.Time `json:"expiresat"`
+	UsedAt      time.Time `json:"usedat,omitempty"`
+	UsedBy      string    `json:"usedby,omitempty"`
+}
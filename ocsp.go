@@ -0,0 +1,160 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// ocspHandler serve the OCSP responder over http, GET and POST as
+// described in RFC 6960 appendix A.
+type ocspHandler struct {
+	signer *serviceCert
+
+	mu        sync.RWMutex
+	responder *ca.OCSPResponder
+}
+
+// ocspURL return the OCSP responder url embedded in issued certificates.
+func ocspURL() string {
+	if conf.HTTPListen == "" || conf.PublicURL == "" {
+		return ""
+	}
+	return conf.PublicURL + "/ocsp"
+}
+
+func ocspValidity() time.Duration {
+	if conf.OCSP.Validity <= 0 {
+		return time.Hour
+	}
+	return time.Duration(conf.OCSP.Validity) * time.Hour
+}
+
+// run build the responder and keep the delegated signing certificate
+// fresh until stop is closed.
+func (h *ocspHandler) run(rca *rootCA, stop <-chan bool) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := h.refresh(rca); err != nil {
+			log.Errorln("OCSP responder: ", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *ocspHandler) refresh(rca *rootCA) error {
+	responder := &ca.OCSPResponder{
+		Issuer:   rca.cert,
+		Signer:   rca.key,
+		Validity: ocspValidity(),
+		Lookup: func(serial *big.Int) (*models.Certificate, error) {
+			rec, err := rca.store.Certificate(db.SerialKey(serial))
+			if err == db.ErrNotFound {
+				return nil, nil
+			}
+			return rec, err
+		},
+	}
+	if conf.OCSP.Delegated {
+		if err := h.signer.refresh(rca); err != nil {
+			return err
+		}
+		responder.Certificate, responder.Signer = h.signer.get()
+	}
+	if rca.previousKey != nil {
+		responder.Previous = &ca.OCSPResponder{
+			Issuer:   rca.rollover.Previous,
+			Signer:   rca.previousKey,
+			Validity: responder.Validity,
+			Lookup:   responder.Lookup,
+		}
+	}
+	h.mu.Lock()
+	h.responder = responder
+	h.mu.Unlock()
+	return nil
+}
+
+// ocspSignerTemplate is the delegated OCSP signing certificate.
+func ocspSignerTemplate() *x509.Certificate {
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   conf.ServiceName + " OCSP responder",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, 30),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtraExtensions:       []pkix.Extension{ca.OCSPNoCheckExtension()},
+		BasicConstraintsValid: true,
+	}
+}
+
+func (h *ocspHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	responder := h.responder
+	h.mu.RUnlock()
+	if responder == nil {
+		http.Error(w, "OCSP responder not yet available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		req, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/ocsp/"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(w, "expected application/ocsp-request", http.StatusUnsupportedMediaType)
+			return
+		}
+		req, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 10<<10))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if r.Method == http.MethodGet {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", int(responder.Validity.Seconds())))
+	}
+	w.Write(responder.Respond(req))
+}
@@ -0,0 +1,71 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// loadProfiles compile the configured profiles, the legacy default profile
+// is used when none is configured.
+func loadProfiles() (map[string]*ca.Profile, error) {
+	configured := conf.Profiles
+	if len(configured) == 0 {
+		configured = map[string]models.Profile{models.DefaultProfileName: models.DefaultProfile}
+	}
+	profiles := make(map[string]*ca.Profile, len(configured))
+	for name, p := range configured {
+		profile, err := ca.NewProfile(name, p)
+		if err != nil {
+			return nil, err
+		}
+		profiles[name] = profile
+	}
+	if _, ok := profiles[defaultProfile()]; !ok {
+		return nil, fmt.Errorf("default profile %s is not configured", defaultProfile())
+	}
+	return profiles, nil
+}
+
+func defaultProfile() string {
+	if conf.DefaultProfile != "" {
+		return conf.DefaultProfile
+	}
+	return models.DefaultProfileName
+}
+
+// selectProfile return the profile name asked by the client, or else
+// requested by csr, or else the default one.
+func (rca *rootCA) selectProfile(csr *x509.CertificateRequest, name string) (*ca.Profile, error) {
+	if name == "" {
+		var err error
+		if name, err = ca.RequestedProfile(csr); err != nil {
+			return nil, err
+		}
+	}
+	if name == "" {
+		name = defaultProfile()
+	}
+	profile, ok := rca.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %s", name)
+	}
+	return profile, nil
+}
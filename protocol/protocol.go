@@ -0,0 +1,186 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package protocol implement the framing of the ezb_pki signing port.
+//
+// A version 1 frame is the magic "EZPK", a version byte, the big endian
+// 4 bytes payload length and the JSON payload. Version 0 is the original
+// protocol: a 2 bytes little endian length followed by the DER CSR, answered
+// by the certificate and the CA certificate framed the same way.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Magic start every version 1 frame.
+const Magic = "EZPK"
+
+// Version1 is the current protocol version.
+const Version1 = 1
+
+// MaxFrameSize limit the payload of a version 1 frame.
+const MaxFrameSize = 1 << 20
+
+// Request types.
+const (
+	TypeSign  = "sign"
+	TypePoll  = "poll"
+	TypeRenew = "renew"
+)
+
+// Response status.
+const (
+	StatusIssued  = "issued"
+	StatusPending = "pending"
+	StatusError   = "error"
+)
+
+// Error codes.
+const (
+	CodeMalformed    = "malformed"
+	CodeTooLarge     = "too_large"
+	CodeVersion      = "unsupported_version"
+	CodeBadCSR       = "bad_csr"
+	CodeUnauthorized = "unauthorized"
+	CodeRejected     = "rejected"
+	CodeNotFound     = "not_found"
+	CodeRefused      = "refused"
+	CodeInternal     = "internal"
+)
+
+// Request is sent by the client. Sign carry a DER CSR, the profile to use
+// and the enrollment token, Poll the id of a queued request. Renew carry
+// the CSR of the TLS client certificate to replace.
+type Request struct {
+	Type    string `json:"type"`
+	CSR     []byte `json:"csr,omitempty"`
+	Profile string `json:"profile,omitempty"`
+	Token   string `json:"token,omitempty"`
+	ID      string `json:"id,omitempty"`
+}
+
+// Response is sent by the server. Chain list the DER CA certificates,
+// issuer first.
+type Response struct {
+	Status      string   `json:"status"`
+	Certificate []byte   `json:"certificate,omitempty"`
+	Chain       [][]byte `json:"chain,omitempty"`
+	ID          string   `json:"id,omitempty"`
+	Error       *Error   `json:"error,omitempty"`
+}
+
+// Error is a structured error sent back to the client.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Errorf build an Error.
+func Errorf(code string, format string, a ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// IsV1 tell if the next bytes of r start a version 1 frame.
+func IsV1(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(Magic))
+	return err == nil && string(magic) == Magic
+}
+
+// WriteFrame write v as a version 1 frame.
+func WriteFrame(w io.Writer, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxFrameSize {
+		return Errorf(CodeTooLarge, "frame of %d bytes exceed %d", len(payload), MaxFrameSize)
+	}
+	header := make([]byte, len(Magic)+5)
+	copy(header, Magic)
+	header[len(Magic)] = Version1
+	binary.BigEndian.PutUint32(header[len(Magic)+1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// ReadFrame read a version 1 frame into v. Protocol violations are
+// returned as *Error.
+func ReadFrame(r io.Reader, v interface{}) error {
+	header := make([]byte, len(Magic)+5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return Errorf(CodeMalformed, "bad magic")
+	}
+	if header[len(Magic)] != Version1 {
+		return Errorf(CodeVersion, "version %d not supported", header[len(Magic)])
+	}
+	size := binary.BigEndian.Uint32(header[len(Magic)+1:])
+	if size > MaxFrameSize {
+		return Errorf(CodeTooLarge, "frame of %d bytes exceed %d", size, MaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return Errorf(CodeMalformed, "%v", err)
+	}
+	return nil
+}
+
+// ReadV0 read a version 0 block.
+func ReadV0(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint16(header))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteV0 write version 0 blocks.
+func WriteV0(w io.Writer, blocks ...[]byte) error {
+	for _, data := range blocks {
+		if len(data) > 0xFFFF {
+			return Errorf(CodeTooLarge, "block of %d bytes exceed version 0 limit", len(data))
+		}
+		header := make([]byte, 2)
+		binary.LittleEndian.PutUint16(header, uint16(len(data)))
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
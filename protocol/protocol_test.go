@@ -0,0 +1,188 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader return at most n bytes per Read, like a slow connection.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+func frame(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// header build a version 1 frame header.
+func header(magic string, version byte, size uint32) []byte {
+	h := append([]byte(magic), version, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(h[len(magic)+1:], size)
+	return h
+}
+
+func errorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	want := Request{Type: TypeSign, CSR: bytes.Repeat([]byte{0x30, 0x82}, 700), Profile: "server", Token: "secret"}
+	raw := append(frame(t, &want), frame(t, &Request{Type: TypePoll, ID: "42"})...)
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"chunks":   func(r io.Reader) io.Reader { return &chunkReader{r, 7} },
+		"half":     iotest.HalfReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			r := wrap(bytes.NewReader(raw))
+			var got Request
+			if err := ReadFrame(r, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			var poll Request
+			if err := ReadFrame(r, &poll); err != nil {
+				t.Fatal(err)
+			}
+			if poll.Type != TypePoll || poll.ID != "42" {
+				t.Errorf("second frame is %+v", poll)
+			}
+			if err := ReadFrame(r, &poll); err != io.EOF {
+				t.Errorf("got %v after the last frame, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	raw := frame(t, &Request{Type: TypeSign, Token: "secret"})
+	for _, n := range []int{3, len(Magic) + 3, len(raw) - 1} {
+		var got Request
+		if err := ReadFrame(bytes.NewReader(raw[:n]), &got); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestFrameRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		code string
+	}{
+		{"too large", header(Magic, Version1, MaxFrameSize+1), CodeTooLarge},
+		{"huge", header(Magic, Version1, 0xFFFFFFFF), CodeTooLarge},
+		{"bad magic", append(header("EZPX", Version1, 2), "{}"...), CodeMalformed},
+		{"version 0", append(header(Magic, 0, 2), "{}"...), CodeVersion},
+		{"version 2", append(header(Magic, 2, 2), "{}"...), CodeVersion},
+		{"bad json", append(header(Magic, Version1, 2), "{]"...), CodeMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Request
+			err := ReadFrame(bytes.NewReader(tt.raw), &got)
+			if code := errorCode(err); code != tt.code {
+				t.Errorf("got %v, want code %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteFrame(&buf, &Request{Type: TypeSign, Token: strings.Repeat("x", MaxFrameSize)})
+	if code := errorCode(err); code != CodeTooLarge {
+		t.Errorf("got %v, want code %s", err, CodeTooLarge)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written", buf.Len())
+	}
+}
+
+func TestIsV1(t *testing.T) {
+	want := Response{Status: StatusIssued, Certificate: []byte{1, 2, 3}, Chain: [][]byte{{4, 5}}}
+	r := bufio.NewReader(iotest.OneByteReader(bytes.NewReader(frame(t, &want))))
+	if !IsV1(r) {
+		t.Fatal("version 1 frame not detected")
+	}
+	if !IsV1(r) {
+		t.Fatal("a second peek does not detect the frame")
+	}
+	var got Response
+	if err := ReadFrame(r, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for name, raw := range map[string][]byte{"empty": nil, "short": []byte("EZP"), "v0": {3, 0, 'E', 'Z', 'P'}} {
+		if IsV1(bufio.NewReader(bytes.NewReader(raw))) {
+			t.Errorf("%s: detected as version 1", name)
+		}
+	}
+}
+
+func TestV0(t *testing.T) {
+	csr := bytes.Repeat([]byte{0x30}, 600)
+	var buf bytes.Buffer
+	if err := WriteV0(&buf, csr, []byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(iotest.OneByteReader(&buf))
+	if IsV1(r) {
+		t.Fatal("version 0 message detected as version 1")
+	}
+	for _, want := range [][]byte{csr, {1, 2}} {
+		got, err := ReadV0(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("got %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if err := WriteV0(&buf, make([]byte, 0x10000)); errorCode(err) != CodeTooLarge {
+		t.Errorf("got %v, want code %s", err, CodeTooLarge)
+	}
+}
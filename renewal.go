@@ -0,0 +1,132 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+)
+
+// renew issue the replacement of the client certificate peer, recorded as
+// current, for the key of csr. The new certificate keeps the subject,
+// names and profile of peer, whatever the CSR asks.
+func (rca *rootCA) renew(csr *x509.CertificateRequest, current *models.Certificate, peer *x509.Certificate, requester string) (*x509.Certificate, error) {
+	if err := rca.checkRenewalKey(csr, current); err != nil {
+		return nil, err
+	}
+	name := current.Profile
+	if name == "" {
+		name = defaultProfile()
+	}
+	profile, err := rca.selectProfile(csr, name)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeRefused, "%v", err)
+	}
+	renewal := *csr
+	renewal.Subject = peer.Subject
+	renewal.DNSNames = peer.DNSNames
+	renewal.IPAddresses = peer.IPAddresses
+	renewal.EmailAddresses = peer.EmailAddresses
+	renewal.URIs = peer.URIs
+	template, err := profile.Template(&renewal, time.Now())
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeRefused, "%v", err)
+	}
+	template.RawSubject = peer.RawSubject
+	template.EmailAddresses = peer.EmailAddresses
+	template.URIs = peer.URIs
+	if err = rca.applyPolicy(template, &renewal); err != nil {
+		return nil, err
+	}
+	if !profile.ShortLived {
+		addRevocationInfo(template)
+	}
+	cert, err := rca.issue(template, csr.PublicKey, profile.Name, requester)
+	if err != nil {
+		return nil, err
+	}
+	serial := db.SerialKey(cert.SerialNumber)
+	rca.metrics.renew(profile.Name, time.Until(current.NotAfter))
+	if err = rca.store.LinkRenewal(current.Serial, serial, time.Now()); err != nil {
+		log.Errorf("Renewal of %s by %s not linked in the inventory: %v", current.Serial, serial, err)
+	} else {
+		log.Printf("%s renewed %s for %s", serial, current.Serial, current.CommonName)
+	}
+	return cert, nil
+}
+
+// checkRenewalKey refuse keeping the key when conf.Renewal.RequireNewKey
+// is set, a key revoked as compromised, and a key certified for another
+// common name.
+func (rca *rootCA) checkRenewalKey(csr *x509.CertificateRequest, current *models.Certificate) error {
+	fp := db.KeyFingerprint(csr.RawSubjectPublicKeyInfo)
+	if fp == current.Fingerprint && conf.Renewal.RequireNewKey {
+		return rca.refuseRenewal(current, "renewal of %s requires a new key", current.Serial)
+	}
+	list, err := rca.store.CertificatesByFingerprint(fp)
+	if err != nil {
+		return err
+	}
+	for _, rec := range list {
+		switch {
+		case rec.Status == models.StatusRevoked && rec.RevocationReason == ca.ReasonKeyCompromise:
+			return rca.refuseRenewal(current, "the key of %s was revoked as compromised", rec.Serial)
+		case rec.CommonName != current.CommonName:
+			return rca.refuseRenewal(current, "the key is certified for another common name")
+		}
+	}
+	return nil
+}
+
+func (rca *rootCA) refuseRenewal(current *models.Certificate, format string, a ...interface{}) error {
+	err := protocol.Errorf(protocol.CodeRefused, format, a...)
+	log.Warningf("Renewal of %s refused: %s", current.Serial, err.Message)
+	return err
+}
+
+// revokeSuperseded revoke the renewed certificates grace after their
+// renewal, until stop is closed. The CRL publisher picks them up.
+func (rca *rootCA) revokeSuperseded(grace time.Duration, stop <-chan bool) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		list, err := rca.store.Certificates(func(rec *models.Certificate) bool {
+			return rec.RenewedBy != "" && rec.CurrentStatus(now) == models.StatusValid && now.Sub(rec.RenewedAt) >= grace
+		})
+		if err != nil {
+			log.Errorln(err)
+		}
+		for _, rec := range list {
+			if err := rca.store.Revoke(rec.Serial, ca.ReasonSuperseded, now); err != nil {
+				log.Errorln(err)
+				continue
+			}
+			log.Printf("%s revoked, superseded by %s", rec.Serial, rec.RenewedBy)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// queueCSR store csr in the approval queue, or return its certificate if
+// an operator already approved it. Every requested name is recorded for
+// the operator, with the profile selected for the request.
+func (rca *rootCA) queueCSR(csr *x509.CertificateRequest, profile string, requester string) (*x509.Certificate, *models.Request, error) {
+	queued := &models.Request{
+		ID:         db.RequestID(csr.Raw),
+		CSR:        csr.Raw,
+		CommonName: csr.Subject.CommonName,
+		DNSNames:   csr.DNSNames,
+		Emails:     csr.EmailAddresses,
+		Profile:    profile,
+		Requester:  requester,
+		Status:     models.RequestPending,
+		CreatedAt:  time.Now(),
+	}
+	for _, ip := range csr.IPAddresses {
+		queued.IPAddresses = append(queued.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		queued.URIs = append(queued.URIs, uri.String())
+	}
+	req, err := rca.store.AddRequest(queued)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rca.pollRequest(req.ID)
+}
+
+// pollRequest return the certificate of an approved request, issuing it on
+// first poll, or nil while the request is pending.
+func (rca *rootCA) pollRequest(id string) (*x509.Certificate, *models.Request, error) {
+	rca.approvals.Lock()
+	defer rca.approvals.Unlock()
+
+	req, err := rca.store.Request(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch req.Status {
+	case models.RequestPending:
+		return nil, req, nil
+	case models.RequestRejected:
+		return nil, req, protocol.Errorf(protocol.CodeRejected, "request %s rejected: %s", id, req.Reason)
+	case models.RequestIssued:
+		rec, err := rca.store.Certificate(req.Serial)
+		if err != nil {
+			return nil, req, err
+		}
+		cert, err := x509.ParseCertificate(rec.Raw)
+		return cert, req, err
+	}
+
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, req, err
+	}
+	cert, err := rca.issueCSR(csr, req.Profile, "", req.Requester)
+	if perr, ok := err.(*protocol.Error); ok {
+		// the profile or the policy refused the request since it was
+		// queued, it is rejected to leave the queue.
+		rerr := rca.store.UpdateRequest(id, func(r *models.Request) error {
+			r.Status = models.RequestRejected
+			r.Reason = perr.Message
+			*req = *r
+			return nil
+		})
+		if rerr != nil {
+			return nil, req, rerr
+		}
+		log.Warningf("Approved request %s of %s refused: %s", id, req.CommonName, perr.Message)
+		return nil, req, err
+	}
+	if err != nil {
+		return nil, req, err
+	}
+	err = rca.store.UpdateRequest(id, func(r *models.Request) error {
+		r.Status = models.RequestIssued
+		r.Serial = db.SerialKey(cert.SerialNumber)
+		*req = *r
+		return nil
+	})
+	if err != nil {
+		return nil, req, err
+	}
+	log.Printf("Approved request %s issued to %s, serial %s", id, req.CommonName, req.Serial)
+	return cert, req, nil
+}
+
+// serveRequest let clients poll a queued request by id, the certificate is
+// returned in PEM followed by the CA chain once approved.
+func (rca *rootCA) serveRequest(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/csr/")
+	cert, _, err := rca.pollRequest(id)
+	switch perr, _ := err.(*protocol.Error); {
+	case err == db.ErrNotFound:
+		http.Error(w, "unknown request", http.StatusNotFound)
+	case perr != nil:
+		http.Error(w, perr.Message, http.StatusForbidden)
+	case err != nil:
+		log.Errorln(err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	case cert == nil:
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "request %s pending\n", id)
+	default:
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		for _, der := range rca.chain {
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+	}
+}
+
+func listRequests(c *cli.Context) error {
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+	all := c.Bool("all")
+	list, err := store.Requests(func(req *models.Request) bool {
+		return all || req.Status == models.RequestPending
+	})
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMON NAME\tDNS NAMES\tIP ADDRESSES\tURIS\tEMAILS\tPROFILE\tREQUESTER\tRECEIVED\tSTATUS")
+	for _, req := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", req.ID, req.CommonName, strings.Join(req.DNSNames, ","), strings.Join(req.IPAddresses, ","),
+			strings.Join(req.URIs, ","), strings.Join(req.Emails, ","), req.Profile, req.Requester, req.CreatedAt.Format(time.RFC3339), req.Status)
+	}
+	return w.Flush()
+}
+
+func decideRequest(c *cli.Context, status string) error {
+	id := c.Args().First()
+	if id == "" {
+		return cli.NewExitError("request id is required", -1)
+	}
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+	err = store.UpdateRequest(id, func(req *models.Request) error {
+		if req.Status != models.RequestPending {
+			return fmt.Errorf("request %s is %s", id, req.Status)
+		}
+		req.Status = status
+		req.Reason = c.String("reason")
+		req.DecidedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	fmt.Printf("Request %s %s.\n", id, status)
+	if status == models.RequestApproved {
+		fmt.Println("The certificate is issued when the node polls again.")
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// normalizeSerial accept hex serials with or without colons and leading
+// zeros, and return the inventory key.
+func normalizeSerial(s string) (string, error) {
+	s = strings.Replace(strings.TrimSpace(s), ":", "", -1)
+	serial, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		return "", fmt.Errorf("invalid serial %q, expected hexadecimal", s)
+	}
+	return db.SerialKey(serial), nil
+}
+
+func revokeCertificate(c *cli.Context) error {
+	reason, err := ca.ParseReason(c.String("reason"))
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	serial, cn := c.String("serial"), c.String("cn")
+	if (serial == "") == (cn == "") {
+		return cli.NewExitError("one of --serial or --cn is required", -1)
+	}
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+
+	var serials []string
+	if serial != "" {
+		key, err := normalizeSerial(serial)
+		if err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		serials = append(serials, key)
+	} else {
+		list, err := store.CertificatesByCommonName(cn)
+		if err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		for _, rec := range list {
+			if rec.Status == models.StatusValid {
+				serials = append(serials, rec.Serial)
+			}
+		}
+		if len(serials) == 0 {
+			return cli.NewExitError(fmt.Sprintf("no valid certificate issued to %s", cn), -1)
+		}
+	}
+
+	now := time.Now()
+	for _, key := range serials {
+		if err := store.Revoke(key, reason, now); err != nil {
+			return cli.NewExitError(fmt.Sprintf("revoke %s: %v", key, err), -1)
+		}
+		fmt.Printf("%s revoked (%s).\n", key, ca.ReasonString(reason))
+	}
+	fmt.Println("The service will publish the new CRL within a minute.")
+	return nil
+}
+
+// revoke the certificate key on behalf of actor and publish the CRL at
+// once, for revocations made through the service.
+func (rca *rootCA) revoke(key string, reason int, actor string) error {
+	if reason == ca.ReasonRemoveFromCRL {
+		return fmt.Errorf("revocation reason %s is only valid in delta CRLs", ca.ReasonString(reason))
+	}
+	if err := rca.store.Revoke(key, reason, time.Now()); err != nil {
+		return err
+	}
+	log.Printf("%s revoked %s (%s)", actor, key, ca.ReasonString(reason))
+	for _, p := range rca.crls() {
+		if err := p.publish(rca); err != nil {
+			log.Errorln("CRL publication failed: ", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/x509"
+	"os"
+	"path"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/setup"
+	log "github.com/sirupsen/logrus"
+)
+
+// loadPreviousKey read the key of the previous root kept by the last
+// rollover, nil when it was moved offline.
+func loadPreviousKey(previous *x509.Certificate) (crypto.Signer, error) {
+	keyFile := path.Join(exPath, "cert/"+conf.ServiceName+"-previous.key")
+	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+		log.Warningf("%s not found, the certificates of the previous root are left out of the CRL and OCSP.", keyFile)
+		return nil, nil
+	}
+	key, err := setup.ReadKeyFile(keyFile, func() ([]byte, error) {
+		return setup.Passphrase(conf, "Previous CA key passphrase: ")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = setup.CheckCA(previous, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// crls return the CRL publishers, the previous root one when its key is
+// loaded.
+func (rca *rootCA) crls() []*crlPublisher {
+	if rca.previousCRL == nil {
+		return []*crlPublisher{rca.crl}
+	}
+	return []*crlPublisher{rca.crl, rca.previousCRL}
+}
+
+// issuedBy tell if cert is signed by the CA, or by the previous root
+// during a rollover transition.
+func (rca *rootCA) issuedBy(cert *x509.Certificate) bool {
+	if cert.CheckSignatureFrom(rca.cert) == nil {
+		return true
+	}
+	return rca.rollover.Active() && cert.CheckSignatureFrom(rca.rollover.Previous) == nil
+}
+
+// endRollover remind to restart the service once the rollover transition
+// is over, the chain and bundle are only chosen at start.
+func (rca *rootCA) endRollover(stop <-chan bool) {
+	timer := time.NewTimer(time.Until(rca.rollover.Until))
+	defer timer.Stop()
+	select {
+	case <-stop:
+	case <-timer.C:
+		log.Warningln("CA rollover transition is over, restart the service to stop serving the previous root.")
+	}
+}
@@ -0,0 +1,413 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
+	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/pkcs7"
+)
+
+// SCEP (RFC 8894) message attributes.
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+// CMS (RFC 5652) content types and the algorithms of scepEnvelope.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAES128CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+)
+
+// SCEP message types, status and failure reasons.
+const (
+	scepCertRep        = "3"
+	scepRenewalReq     = "17"
+	scepPKCSReq        = "19"
+	scepGetCertInitial = "20"
+
+	scepSuccess = "0"
+	scepFailure = "2"
+	scepPending = "3"
+
+	scepBadAlg          = "0"
+	scepBadMessageCheck = "1"
+	scepBadRequest      = "2"
+)
+
+const scepCaps = "Renewal\nSHA-256\nAES\nPOSTPKIOperation\nSCEPStandard\n"
+
+// scepHandler serve SCEP at /scep. Requests are encrypted to an RSA
+// registration authority certificate since the CA key may not support key
+// transport. Clients authenticate with an enrollment token as challenge
+// password, or renew by signing with their current certificate.
+type scepHandler struct {
+	rca *rootCA
+	ra  *serviceCert
+}
+
+// newSCEPHandler create the SCEP handler of rca.
+func newSCEPHandler(rca *rootCA) *scepHandler {
+	return &scepHandler{rca: rca, ra: &serviceCert{name: "scep", template: scepRATemplate, rsaKey: true}}
+}
+
+// scepRATemplate is the SCEP registration authority certificate.
+func scepRATemplate() *x509.Certificate {
+	return &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   conf.ServiceName + " SCEP RA",
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+	}
+}
+
+func (h *scepHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch op := r.URL.Query().Get("operation"); op {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(scepCaps))
+	case "GetCACert":
+		ra, _ := h.ra.get()
+		certs := append([]byte{}, ra.Raw...)
+		for _, der := range h.rca.chain {
+			certs = append(certs, der...)
+		}
+		p7, err := pkcs7.DegenerateCertificate(certs)
+		if err != nil {
+			log.Errorln(err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+		w.Write(p7)
+	case "PKIOperation":
+		var msg []byte
+		var err error
+		if r.Method == http.MethodPost {
+			msg, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, protocol.MaxFrameSize))
+		} else {
+			msg, err = base64.StdEncoding.DecodeString(r.URL.Query().Get("message"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := h.pkiOperation(msg, "scep:"+r.RemoteAddr)
+		if err != nil {
+			if _, ok := err.(*protocol.Error); ok {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else {
+				log.Errorln("SCEP: ", err)
+				http.Error(w, "internal error", http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Write(resp)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported operation %q", op), http.StatusBadRequest)
+	}
+}
+
+// scepRequest is a verified and decrypted pkiMessage.
+type scepRequest struct {
+	signer        *x509.Certificate
+	messageType   string
+	transactionID string
+	senderNonce   []byte
+	content       []byte
+}
+
+// pkiOperation answer a CertRep to msg. Errors are returned for messages
+// too broken to answer, as *protocol.Error when the client is at fault.
+func (h *scepHandler) pkiOperation(msg []byte, requester string) ([]byte, error) {
+	rca := h.rca
+	req, err := h.parse(msg)
+	if err != nil {
+		return nil, protocol.Errorf(protocol.CodeMalformed, "%v", err)
+	}
+	if _, ok := req.signer.PublicKey.(*rsa.PublicKey); !ok {
+		return h.certRep(req, nil, scepFailure, scepBadAlg)
+	}
+
+	var cert *x509.Certificate
+	var queued *models.Request
+	switch req.messageType {
+	case scepPKCSReq, scepRenewalReq:
+		csr, err := x509.ParseCertificateRequest(req.content)
+		if err != nil {
+			return h.certRep(req, nil, scepFailure, scepBadRequest)
+		}
+		var peer *x509.Certificate
+		if req.messageType == scepRenewalReq {
+			if !rca.issuedBy(req.signer) {
+				return h.certRep(req, nil, scepFailure, scepBadMessageCheck)
+			}
+			peer = req.signer
+		}
+		cert, queued, err = rca.enroll(&enrollment{
+			csr:       csr,
+			profile:   conf.SCEP.Profile,
+			requester: requester,
+			peer:      peer,
+		})
+		if err == nil && cert == nil {
+			err = rca.store.UpdateRequest(queued.ID, func(r *models.Request) error {
+				r.Transaction = req.transactionID
+				return nil
+			})
+		}
+		if err != nil {
+			return h.failure(req, err)
+		}
+	case scepGetCertInitial:
+		list, err := rca.store.Requests(func(r *models.Request) bool {
+			return r.Transaction == req.transactionID
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return h.certRep(req, nil, scepFailure, scepBadRequest)
+		}
+		// only the requester, signing with the key of its CSR, gets the
+		// certificate of a transaction
+		csr, err := x509.ParseCertificateRequest(list[0].CSR)
+		if err != nil {
+			return nil, err
+		}
+		if !sameKey(req.signer, csr.PublicKey) {
+			log.Warningf("SCEP transaction %s polled with another key", req.transactionID)
+			return h.certRep(req, nil, scepFailure, scepBadMessageCheck)
+		}
+		if cert, queued, err = rca.pollRequest(list[0].ID); err != nil {
+			return h.failure(req, err)
+		}
+	default:
+		return h.certRep(req, nil, scepFailure, scepBadRequest)
+	}
+
+	if cert == nil {
+		return h.certRep(req, nil, scepPending, "")
+	}
+	log.Println("Transmitted client Certificate to ", cert.Subject.CommonName, " over SCEP")
+	return h.certRep(req, cert, scepSuccess, "")
+}
+
+// failure answer enrollment errors meant for the client, others are
+// returned.
+func (h *scepHandler) failure(req *scepRequest, err error) ([]byte, error) {
+	perr, ok := err.(*protocol.Error)
+	if !ok {
+		return nil, err
+	}
+	log.Warningf("SCEP transaction %s refused: %v", req.transactionID, perr)
+	return h.certRep(req, nil, scepFailure, scepBadRequest)
+}
+
+func (h *scepHandler) parse(msg []byte) (*scepRequest, error) {
+	p7, err := pkcs7.Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+	if err = p7.Verify(); err != nil {
+		return nil, err
+	}
+	req := &scepRequest{signer: p7.GetOnlySigner()}
+	if req.signer == nil {
+		return nil, errors.New("pkiMessage must have a single signer")
+	}
+	if err = p7.UnmarshalSignedAttribute(oidSCEPMessageType, &req.messageType); err != nil {
+		return nil, err
+	}
+	if err = p7.UnmarshalSignedAttribute(oidSCEPTransactionID, &req.transactionID); err != nil {
+		return nil, err
+	}
+	if err = p7.UnmarshalSignedAttribute(oidSCEPSenderNonce, &req.senderNonce); err != nil {
+		return nil, err
+	}
+
+	envelope, err := pkcs7.Parse(p7.Content)
+	if err != nil {
+		return nil, err
+	}
+	ra, key := h.ra.get()
+	if req.content, err = envelope.Decrypt(ra, key); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// certRep sign the reply to req, carrying cert encrypted to the requester
+// on success.
+func (h *scepHandler) certRep(req *scepRequest, cert *x509.Certificate, status string, failInfo string) ([]byte, error) {
+	var content []byte
+	if cert != nil {
+		degenerate, err := pkcs7.DegenerateCertificate(cert.Raw)
+		if err != nil {
+			return nil, err
+		}
+		if content, err = scepEnvelope(degenerate, req.signer); err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	attrs := []pkcs7.Attribute{
+		{Type: oidSCEPMessageType, Value: scepCertRep},
+		{Type: oidSCEPPKIStatus, Value: status},
+		{Type: oidSCEPTransactionID, Value: req.transactionID},
+		{Type: oidSCEPSenderNonce, Value: nonce},
+		{Type: oidSCEPRecipientNonce, Value: req.senderNonce},
+	}
+	if failInfo != "" {
+		attrs = append(attrs, pkcs7.Attribute{Type: oidSCEPFailInfo, Value: failInfo})
+	}
+
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	ra, key := h.ra.get()
+	if err = sd.AddSigner(ra, key, pkcs7.SignerInfoConfig{ExtraSignedAttributes: attrs}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// sameKey tell if cert is for the public key pub.
+func sameKey(cert *x509.Certificate, pub interface{}) bool {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	return err == nil && bytes.Equal(der, cert.RawSubjectPublicKeyInfo)
+}
+
+// CMS EnvelopedData with a single RSA key transport recipient.
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []keyTransRecipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerialNumber
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// scepEnvelope encrypt content to the RSA key of recipient with
+// AES-128-CBC, the algorithm announced by GetCACaps. pkcs7.Encrypt takes
+// the algorithm from a package variable, shared with every other user.
+func scepEnvelope(content []byte, recipient *x509.Certificate) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("SCEP recipient key is not RSA")
+	}
+	key := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS#7 padding, a full block when content is aligned
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope, err := asn1.Marshal(envelopedData{
+		RecipientInfos: []keyTransRecipientInfo{{
+			IssuerAndSerialNumber: issuerAndSerialNumber{
+				Issuer:       asn1.RawValue{FullBytes: recipient.RawIssuer},
+				SerialNumber: recipient.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES128CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: encrypted},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: envelope},
+	})
+}
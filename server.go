@@ -17,23 +17,29 @@ package main
 
 import (
 	"bufio"
-	"crypto/ecdsa"
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
-	"encoding/binary"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"math/big"
 	"net"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/ezbastion/ezb_lib/logmanager"
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
 	"github.com/ezbastion/ezb_pki/models"
+	"github.com/ezbastion/ezb_pki/protocol"
 	"github.com/ezbastion/ezb_pki/setup"
 	log "github.com/sirupsen/logrus"
 
@@ -50,7 +56,48 @@ func init() {
 	logmanager.SetLogLevel(conf.Logger.LogLevel, exPath, path.Join(exPath, "log/ezb_pki.log"), conf.Logger.MaxSize, conf.Logger.MaxBackups, conf.Logger.MaxAge, true, true, true)
 }
 
+// rootCA hold what signconn needs to issue certificates. cert is the
+// signing CA, chain the DER certificates from it up to the root and bundle
+// the roots and cross-certificates clients should trust.
+type rootCA struct {
+	cert     *x509.Certificate
+	chain    [][]byte
+	bundle   [][]byte
+	rollover *setup.Rollover
+	key      crypto.Signer
+	serials  *ca.SerialAllocator
+	store    *db.Store
+	crl      *crlPublisher
+	ocsp     *ocspHandler
+	tlsCert  *serviceCert
+	scep     *scepHandler
+	profiles map[string]*ca.Profile
+	metrics  *metrics
+	policy   *ca.Policy
+
+	// previousKey sign the CRL and OCSP responses about the certificates
+	// of the previous root, nil without rollover or once moved offline.
+	previousKey crypto.Signer
+	previousCRL *crlPublisher
+
+	// approvals serialize the issuance of approved requests.
+	approvals sync.Mutex
+}
+
+func openStore() (*db.Store, error) {
+	folder := path.Join(exPath, "db")
+	if err := os.MkdirAll(folder, 0700); err != nil {
+		return nil, err
+	}
+	return db.Open(path.Join(folder, conf.ServiceName+".db"))
+}
+
 func startRootCAServer(serverchan *chan bool) error {
+	if setup.RequestPending(conf) {
+		err := errors.New("the CA certificate is not installed yet, run ezb_pki ca install-cert")
+		log.Errorln(err)
+		return err
+	}
 	caPublicKeyFile, err := ioutil.ReadFile(path.Join(exPath, "cert/"+conf.ServiceName+"-ca.crt"))
 	if err != nil {
 		cli.NewExitError(err, -1)
@@ -65,28 +112,152 @@ func startRootCAServer(serverchan *chan bool) error {
 	}
 	log.Println("Root CA loaded.")
 
-	fp := sha1.Sum(caCRT.Raw)
-	log.Printf("fingerprint, %v\n ", fp)
-
-	caPrivateKeyFile, err := ioutil.ReadFile(path.Join(exPath, "cert/"+conf.ServiceName+"-ca.key"))
+	chain, err := loadChain(caCRT)
 	if err != nil {
-		cli.NewExitError(err, -1)
+		log.Errorln(err)
+		return err
 	}
-	pemBlock, _ = pem.Decode(caPrivateKeyFile)
-	if pemBlock == nil {
-		cli.NewExitError(err, -1)
+	if len(chain) > 1 {
+		log.Printf("Signing with an intermediate CA, %d certificates in chain.", len(chain))
 	}
+	bundle := [][]byte{chain[len(chain)-1]}
+	rollover, err := setup.LoadRollover(conf)
+	if err != nil {
+		log.Errorln(err)
+		return err
+	}
+	if rollover.Active() && !bytes.Equal(rollover.CrossNew.RawSubjectPublicKeyInfo, caCRT.RawSubjectPublicKeyInfo) {
+		log.Warningln("CA rollover ignored, its cross-certificate is not for the current CA key.")
+		rollover = nil
+	}
+	if rollover.Active() {
+		log.Printf("CA rollover in transition until %s, the chain ends with the previous root.", rollover.Until.Format(time.RFC3339))
+		chain = [][]byte{rollover.CrossNew.Raw, rollover.Previous.Raw}
+		bundle = append(bundle, rollover.Previous.Raw, rollover.CrossNew.Raw, rollover.CrossPrevious.Raw)
+	}
+	root := bundle[0]
+	fp := sha1.Sum(root)
+	log.Printf("fingerprint, %v\n ", fp)
+	log.Printf("SHA-256 fingerprint, %X\n ", sha256.Sum256(root))
 
-	caPrivateKey, err := x509.ParseECPrivateKey(pemBlock.Bytes)
+	var caPrivateKey crypto.Signer
+	if conf.HSM.Module != "" {
+		token, err := setup.OpenHSM(conf)
+		if err != nil {
+			log.Errorln(err)
+			return err
+		}
+		defer token.Close()
+		caPrivateKey, err = token.FindKey(setup.HSMKeyLabel(conf))
+		if err != nil {
+			log.Errorln(err)
+			return err
+		}
+	} else {
+		caPrivateKey, err = setup.ReadKeyFile(path.Join(exPath, "cert/"+conf.ServiceName+"-ca.key"), func() ([]byte, error) {
+			return setup.Passphrase(conf, "CA key passphrase: ")
+		})
+		if err != nil {
+			log.Errorln(err)
+			return err
+		}
+	}
+	if err = setup.CheckCA(caCRT, caPrivateKey); err != nil {
+		log.Errorln(err)
+		return err
+	}
+	sigAlg, _, _, err := ca.SignatureAlgorithm(caPrivateKey.Public())
 	if err != nil {
-		cli.NewExitError(err, -1)
+		log.Errorln(err)
+		return err
 	}
-	log.Println("Private key loaded.")
+	log.Printf("Private key loaded, signing with %s.", sigAlg)
 
 	listener, err := net.Listen("tcp", conf.Listen)
 	if err != nil {
 		cli.NewExitError(err, -1)
 	}
+	store, err := openStore()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	log.Println("Inventory loaded.")
+	profiles, err := loadProfiles()
+	if err != nil {
+		log.Errorln(err)
+		return err
+	}
+	policy, err := ca.NewPolicy(conf.Policy)
+	if err != nil {
+		log.Errorln(err)
+		return err
+	}
+	rca := &rootCA{
+		cert:     caCRT,
+		chain:    chain,
+		bundle:   bundle,
+		rollover: rollover,
+		key:      caPrivateKey,
+		serials:  ca.NewSerialAllocator(path.Join(exPath, "cert/"+conf.ServiceName+"-ca.srl")),
+		store:    store,
+		crl:      &crlPublisher{issuer: caCRT, key: caPrivateKey, name: conf.ServiceName},
+		ocsp:     &ocspHandler{signer: &serviceCert{name: "ocsp", template: ocspSignerTemplate}},
+		tlsCert:  &serviceCert{name: "server", template: tlsServerTemplate},
+		profiles: profiles,
+		metrics:  newMetrics(),
+		policy:   policy,
+	}
+	rca.scep = newSCEPHandler(rca)
+	if rollover != nil {
+		if rca.previousKey, err = loadPreviousKey(rollover.Previous); err != nil {
+			log.Errorln("previous CA key: ", err)
+			return err
+		}
+	}
+	if rca.previousKey != nil {
+		rca.previousCRL = &crlPublisher{issuer: rollover.Previous, key: rca.previousKey, name: conf.ServiceName + "-previous"}
+		go rca.previousCRL.run(rca, *serverchan)
+	}
+	if rca.cert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		log.Warningln("Root CA has no cRLSign key usage, some clients may reject its CRL.")
+	}
+	if rollover.Active() {
+		go rca.endRollover(*serverchan)
+	}
+	if conf.Renewal.RevokeAfter != "" {
+		grace, err := ca.ParseValidity(conf.Renewal.RevokeAfter)
+		if err != nil {
+			log.Errorln("renewal revokeafter: ", err)
+			return err
+		}
+		go rca.revokeSuperseded(grace, *serverchan)
+	}
+	go rca.crl.run(rca, *serverchan)
+	go rca.ocsp.run(rca, *serverchan)
+	if conf.SCEP.Enabled {
+		if err = rca.scep.ra.refresh(rca); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		go rca.scep.ra.run(rca, *serverchan)
+	}
+	go startHTTPServer(rca, *serverchan)
+	if conf.TLS || conf.EST.Listen != "" || conf.ACME.Listen != "" || conf.API.Listen != "" || conf.GRPC.Listen != "" {
+		if err = rca.tlsCert.refresh(rca); err != nil {
+			log.Errorln(err)
+			return err
+		}
+		go rca.tlsCert.run(rca, *serverchan)
+		go startESTServer(rca, *serverchan)
+		go startACMEServer(rca, *serverchan)
+		go startAPIServer(rca, *serverchan)
+		go startGRPCServer(rca, *serverchan)
+	}
+	if conf.TLS {
+		listener = tls.NewListener(listener, rca.tlsConfig())
+	}
+
 	log.Println("Listen at ", conf.Listen)
 	defer func() {
 		listener.Close()
@@ -100,89 +271,137 @@ func startRootCAServer(serverchan *chan bool) error {
 			cli.NewExitError(err, -1)
 			break
 		}
-		go signconn(conn, caCRT, caPrivateKey)
+		go signconn(conn, rca)
 	}
 	return nil
 }
 
-func signconn(conn net.Conn, rootCert *x509.Certificate, privateKey *ecdsa.PrivateKey) error {
-	defer conn.Close()
-
-	reader := bufio.NewReader(conn)
-	header := make([]byte, 2)
-	_, err := reader.Read(header)
+// loadChain read cert/<servicename>-chain.crt, the certificates from the
+// signing CA up to the root. Without the file the signing CA is the root.
+func loadChain(signing *x509.Certificate) ([][]byte, error) {
+	file := path.Join(exPath, "cert/"+conf.ServiceName+"-chain.crt")
+	raw, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return [][]byte{signing.Raw}, nil
+	}
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		chain = append(chain, cert)
 	}
-	asn1DataSize := binary.LittleEndian.Uint16(header)
+	if len(chain) == 0 || !chain[0].Equal(signing) {
+		return nil, fmt.Errorf("%s does not start with the signing CA certificate", file)
+	}
+	der := [][]byte{signing.Raw}
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return nil, fmt.Errorf("%s: %s is not signed by %s: %v", file, chain[i-1].Subject, chain[i].Subject, err)
+		}
+		der = append(der, chain[i].Raw)
+	}
+	return der, nil
+}
 
-	asn1Data := make([]byte, asn1DataSize)
-	_, err = reader.Read(asn1Data)
+// issue sign template for pub with a fresh serial and record the
+// certificate in the inventory.
+func (rca *rootCA) issue(template *x509.Certificate, pub interface{}, profile string, requester string) (*x509.Certificate, error) {
+	serial, err := rca.serials.Next()
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-	clientCSR, err := x509.ParseCertificateRequest(asn1Data)
+	template.SerialNumber = serial
+	template.SignatureAlgorithm, _, _, err = ca.SignatureAlgorithm(rca.key.Public())
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
 	}
-	if err = clientCSR.CheckSignature(); err != nil {
-		log.Println(err)
-		return err
+	der, err := x509.CreateCertificate(rand.Reader, template, rca.cert, pub, rca.key)
+	if err != nil {
+		return nil, err
 	}
-	clientCRTTemplate := &x509.Certificate{
-		SerialNumber:          big.NewInt(2),
-		Signature:             clientCSR.Signature,
-		SignatureAlgorithm:    clientCSR.SignatureAlgorithm,
-		PublicKey:             clientCSR.PublicKey,
-		PublicKeyAlgorithm:    clientCSR.PublicKeyAlgorithm,
-		Issuer:                rootCert.Subject,
-		Subject:               clientCSR.Subject,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(10, 0, 0),
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
-		DNSNames:              clientCSR.DNSNames,
-		BasicConstraintsValid: true,
-	}
-	certData, err := x509.CreateCertificate(rand.Reader, clientCRTTemplate, rootCert, clientCSR.PublicKey, privateKey)
+	cert, err := x509.ParseCertificate(der)
 	if err != nil {
-		log.Println(err)
-		return err
+		return nil, err
+	}
+	rec := db.NewCertificate(cert, requester)
+	rec.Profile = profile
+	if err = rca.store.AddCertificate(rec); err != nil {
+		return nil, err
+	}
+	rca.metrics.issue(profile)
+	return cert, nil
+}
+
+// addRevocationInfo point the certificate to the published CRL and OCSP
+// responder.
+func addRevocationInfo(template *x509.Certificate) {
+	if url := crlURL(); url != "" {
+		template.CRLDistributionPoints = []string{url}
 	}
+	if url := ocspURL(); url != "" {
+		template.OCSPServer = []string{url}
+		template.IssuingCertificateURL = []string{conf.PublicURL + "/ca.crt"}
+	}
+}
 
+// connTimeout bound a whole exchange on the signing port.
+const connTimeout = 30 * time.Second
+
+func signconn(conn net.Conn, rca *rootCA) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(connTimeout))
+
+	reader := bufio.NewReader(conn)
 	writer := bufio.NewWriter(conn)
+	if protocol.IsV1(reader) {
+		resp := rca.serveV1(conn, reader)
+		if err := protocol.WriteFrame(writer, resp); err != nil {
+			log.Println(err)
+			return err
+		}
+		return writer.Flush()
+	}
 
-	certHeader := make([]byte, 2)
-	binary.LittleEndian.PutUint16(certHeader, uint16(len(certData)))
-	_, err = writer.Write(certHeader)
+	asn1Data, err := protocol.ReadV0(reader)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-
-	_, err = writer.Write(certData)
+	clientCSR, err := x509.ParseCertificateRequest(asn1Data)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-
-	rootCertHeader := make([]byte, 2)
-	binary.LittleEndian.PutUint16(rootCertHeader, uint16(len(rootCert.Raw)))
-	_, err = writer.Write(rootCertHeader)
+	peer, err := peerCertificate(conn)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-
-	_, err = writer.Write(rootCert.Raw)
+	clientCert, req, err := rca.enroll(&enrollment{
+		csr:       clientCSR,
+		requester: conn.RemoteAddr().String(),
+		peer:      peer,
+	})
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if clientCert == nil {
+		// version 0 clients get an empty certificate and the id to poll with.
+		err = protocol.WriteV0(writer, nil, []byte(req.ID))
+	} else {
+		// version 0 clients read two blocks, they get the signing CA.
+		err = protocol.WriteV0(writer, clientCert.Raw, rca.cert.Raw)
+	}
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-
 	err = writer.Flush()
 	if err != nil {
 		log.Println(err)
@@ -192,3 +411,73 @@ func signconn(conn net.Conn, rootCert *x509.Certificate, privateKey *ecdsa.Priva
 
 	return nil
 }
+
+// serveV1 answer a version 1 request, errors included.
+func (rca *rootCA) serveV1(conn net.Conn, reader *bufio.Reader) protocol.Response {
+	var req protocol.Request
+	if err := protocol.ReadFrame(reader, &req); err != nil {
+		if _, ok := err.(*protocol.Error); !ok {
+			err = protocol.Errorf(protocol.CodeMalformed, "%v", err)
+		}
+		return errorResponse(err)
+	}
+
+	var cert *x509.Certificate
+	var queued *models.Request
+	switch req.Type {
+	case protocol.TypeSign, protocol.TypeRenew:
+		csr, err := x509.ParseCertificateRequest(req.CSR)
+		if err != nil {
+			return errorResponse(protocol.Errorf(protocol.CodeBadCSR, "%v", err))
+		}
+		peer, err := peerCertificate(conn)
+		if err != nil {
+			return errorResponse(protocol.Errorf(protocol.CodeUnauthorized, "%v", err))
+		}
+		if peer == nil && req.Type == protocol.TypeRenew {
+			return errorResponse(protocol.Errorf(protocol.CodeUnauthorized, "client certificate required"))
+		}
+		cert, queued, err = rca.enroll(&enrollment{
+			csr:       csr,
+			profile:   req.Profile,
+			token:     req.Token,
+			requester: conn.RemoteAddr().String(),
+			peer:      peer,
+		})
+		if err != nil {
+			return errorResponse(err)
+		}
+	case protocol.TypePoll:
+		var err error
+		cert, queued, err = rca.pollRequest(req.ID)
+		if err == db.ErrNotFound {
+			return errorResponse(protocol.Errorf(protocol.CodeNotFound, "unknown request %s", req.ID))
+		}
+		if err != nil {
+			return errorResponse(err)
+		}
+	default:
+		return errorResponse(protocol.Errorf(protocol.CodeMalformed, "unknown request type %q", req.Type))
+	}
+
+	if cert == nil {
+		return protocol.Response{Status: protocol.StatusPending, ID: queued.ID}
+	}
+	log.Println("Transmitted client Certificate to ", cert.Subject.CommonName)
+	return protocol.Response{
+		Status:      protocol.StatusIssued,
+		Certificate: cert.Raw,
+		Chain:       rca.chain,
+	}
+}
+
+// errorResponse report err to the client, internal errors are logged and
+// not detailed.
+func errorResponse(err error) protocol.Response {
+	perr, ok := err.(*protocol.Error)
+	if !ok {
+		log.Errorln(err)
+		perr = protocol.Errorf(protocol.CodeInternal, "internal error")
+	}
+	return protocol.Response{Status: protocol.StatusError, Error: perr}
+}
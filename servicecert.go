@@ -0,0 +1,140 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/setup"
+	log "github.com/sirupsen/logrus"
+)
+
+// serviceCert is a certificate the daemon issue to itself, such as the
+// delegated OCSP signer or the TLS server certificate. It is kept in the
+// cert folder as <servicename>-<name>.crt/key and replaced when less than a
+// third of its lifetime remains. The key is P-256, or RSA 2048 when rsaKey
+// is set for protocols needing key transport.
+type serviceCert struct {
+	name     string
+	template func() *x509.Certificate
+	rsaKey   bool
+
+	mu   sync.RWMutex
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func (s *serviceCert) get() (*x509.Certificate, crypto.Signer) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, s.key
+}
+
+func (s *serviceCert) files() (string, string) {
+	base := path.Join(exPath, "cert/"+conf.ServiceName+"-"+s.name)
+	return base + ".crt", base + ".key"
+}
+
+func renewalDue(cert *x509.Certificate) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return time.Until(cert.NotAfter) < lifetime/3
+}
+
+// refresh load the certificate from the cert folder, or issue a new one
+// when missing, not issued by rca or due for renewal.
+func (s *serviceCert) refresh(rca *rootCA) error {
+	if cert, _ := s.get(); cert != nil && !renewalDue(cert) {
+		return nil
+	}
+	certFile, keyFile := s.files()
+	cert, key, err := setup.LoadKeyPair(certFile, keyFile)
+	if err == nil && cert.CheckSignatureFrom(rca.cert) == nil && !renewalDue(cert) && s.keyMatches(key) {
+		s.set(cert, key)
+		return nil
+	}
+
+	var block *pem.Block
+	if s.rsaKey {
+		var rsaKey *rsa.PrivateKey
+		if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return err
+		}
+		key = rsaKey
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	} else {
+		var ecKey *ecdsa.PrivateKey
+		if ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return err
+		}
+		key = ecKey
+		b, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
+	}
+	cert, err = rca.issue(s.template(), key.Public(), "", conf.ServiceName)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		return err
+	}
+	log.Printf("%s certificate issued, serial %s", s.name, db.SerialKey(cert.SerialNumber))
+	s.set(cert, key)
+	return nil
+}
+
+// run refresh the certificate every hour until stop is closed.
+func (s *serviceCert) run(rca *rootCA, stop <-chan bool) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.refresh(rca); err != nil {
+				log.Errorf("%s certificate: %v", s.name, err)
+			}
+		}
+	}
+}
+
+func (s *serviceCert) keyMatches(key crypto.Signer) bool {
+	_, isRSA := key.(*rsa.PrivateKey)
+	return isRSA == s.rsaKey
+}
+
+func (s *serviceCert) set(cert *x509.Certificate, key crypto.Signer) {
+	s.mu.Lock()
+	s.cert, s.key = cert, key
+	s.mu.Unlock()
+}
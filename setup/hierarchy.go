@@ -0,0 +1,405 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/hsm"
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// Options select the CA hierarchy created by Setup.
+type Options struct {
+	// Intermediates is the number of CAs between the root and the CA
+	// signing the nodes certificates. With none, and no RootCert, the
+	// signing CA is a self-signed root as in earlier versions.
+	Intermediates int
+	// RootCert and RootKey are the PEM files of an existing root signing
+	// the intermediates, a new root is created when empty.
+	RootCert string
+	RootKey  string
+	// KeyType is the algorithm of the new CA keys, one of KeyTypes,
+	// p256 when empty.
+	KeyType string
+	// CSR create the CA key and a certificate request for an external CA
+	// instead of a certificate.
+	CSR bool
+	// Import is a PEM or PKCS#12 file holding the CA certificate issued
+	// by an external CA, and its key unless ImportKey is set or the key
+	// was created by CSR.
+	Import    string
+	ImportKey string
+	// ExternalCA create the request like CSR, its certificate is
+	// installed with InstallCert after path validation to TrustAnchor, a
+	// PEM file of the parent PKI roots saved in the configuration.
+	ExternalCA  bool
+	TrustAnchor string
+	// Unencrypted store the new CA keys in clear, a passphrase is required
+	// otherwise.
+	Unencrypted bool
+}
+
+// KeyTypes list the CA key algorithms accepted by Setup.
+var KeyTypes = []string{"p256", "p384", "p521", "rsa2048", "rsa3072", "rsa4096", "ed25519"}
+
+func validKeyType(keyType string) bool {
+	if keyType == "" {
+		return true
+	}
+	for _, t := range KeyTypes {
+		if strings.EqualFold(t, keyType) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewKey generate a private key of one of KeyTypes, p256 when empty.
+func NewKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "", "p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "p521":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "rsa2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, use one of %s", keyType, strings.Join(KeyTypes, ", "))
+}
+
+// certFile return the path of cert/<servicename>-<name>.<ext>.
+func certFile(conf models.Configuration, name string, ext string) string {
+	return path.Join(exPath, "cert/"+conf.ServiceName+"-"+name+"."+ext)
+}
+
+// createHierarchy create or load the root, then the intermediates, the
+// last one being the signing CA saved as <servicename>-ca.crt/key. The
+// chain from the signing CA up to the root is saved as
+// <servicename>-chain.crt.
+func createHierarchy(conf models.Configuration, opts Options, passphrase []byte) error {
+	serials := ca.NewSerialAllocator(certFile(conf, "ca", "srl"))
+	var root *x509.Certificate
+	var rootKey crypto.Signer
+	var err error
+	if opts.RootCert != "" {
+		if root, err = ReadCertFile(opts.RootCert); err != nil {
+			return err
+		}
+		rootKey, err = ReadKeyFile(opts.RootKey, func() ([]byte, error) {
+			return Passphrase(models.Configuration{}, "Root key passphrase: ")
+		})
+		if err != nil {
+			return err
+		}
+		if err = CheckCA(root, rootKey); err != nil {
+			return fmt.Errorf("%s: %v", opts.RootCert, err)
+		}
+		log.Println("Root certificate loaded from ", opts.RootCert)
+	} else {
+		if rootKey, err = NewKey(opts.KeyType); err != nil {
+			return err
+		}
+		root, err = newCA(serials, rootKey, conf.ServiceName+" Root CA", nil, nil, time.Now().AddDate(20, 0, 0), -1)
+		if err != nil {
+			return err
+		}
+		if err = saveKeyPair(conf, "root", root, rootKey, passphrase); err != nil {
+			return err
+		}
+	}
+
+	n := opts.Intermediates
+	if n < 1 {
+		n = 1
+	}
+	chain := []*x509.Certificate{root}
+	parent, parentKey := root, rootKey
+	for i := 1; i <= n; i++ {
+		name, cn := fmt.Sprintf("int%d", i), fmt.Sprintf("%s Intermediate CA %d", conf.ServiceName, i)
+		if i == n {
+			name, cn = "ca", conf.ServiceName
+		}
+		notAfter := time.Now().AddDate(10, 0, 0)
+		if notAfter.After(parent.NotAfter) {
+			notAfter = parent.NotAfter
+		}
+		var key crypto.Signer
+		if i == n {
+			var token hsm.Token
+			if key, token, err = newSigningKey(conf, opts.KeyType); err != nil {
+				return err
+			}
+			if token != nil {
+				defer token.Close()
+			}
+		} else if key, err = NewKey(opts.KeyType); err != nil {
+			return err
+		}
+		cert, err := newCA(serials, key, cn, parent, parentKey, notAfter, n-i)
+		if err != nil {
+			return err
+		}
+		if i == n && conf.HSM.Module != "" {
+			err = saveCert(conf, name, cert)
+		} else {
+			err = saveKeyPair(conf, name, cert, key, passphrase)
+		}
+		if err != nil {
+			return err
+		}
+		chain = append([]*x509.Certificate{cert}, chain...)
+		parent, parentKey = cert, key
+	}
+
+	if err = saveChain(conf, chain); err != nil {
+		return err
+	}
+	if opts.RootCert == "" {
+		fmt.Printf("\nMove %s to offline storage.\n", certFile(conf, "root", "key"))
+	}
+	for i := 1; i < n; i++ {
+		fmt.Printf("Move %s to offline storage.\n", certFile(conf, fmt.Sprintf("int%d", i), "key"))
+	}
+	return nil
+}
+
+// saveChain write the certificates from the signing CA up to the root
+// in <servicename>-chain.crt.
+func saveChain(conf models.Configuration, chain []*x509.Certificate) error {
+	var buf bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	chainFile := certFile(conf, "chain", "crt")
+	if err := ioutil.WriteFile(chainFile, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	log.Println("CA chain saved at ", chainFile)
+	return nil
+}
+
+// newCA create a CA certificate for key, signed by parent or self-signed
+// when parent is nil. maxPathLen -1 means no limit.
+func newCA(serials *ca.SerialAllocator, key crypto.Signer, cn string, parent *x509.Certificate, parentKey crypto.Signer, notAfter time.Time, maxPathLen int) (*x509.Certificate, error) {
+	if parentKey == nil {
+		parentKey = key
+	}
+	sigAlg, _, _, err := ca.SignatureAlgorithm(parentKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serials.Next()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   cn,
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+		SignatureAlgorithm:    sigAlg,
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func saveKeyPair(conf models.Configuration, name string, cert *x509.Certificate, key crypto.Signer, passphrase []byte) error {
+	block, err := encodeKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	keyFile := certFile(conf, name, "key")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	log.Println("Private key saved at " + keyFile)
+	return saveCert(conf, name, cert)
+}
+
+func saveCert(conf models.Configuration, name string, cert *x509.Certificate) error {
+	crtFile := certFile(conf, name, "crt")
+	if err := ioutil.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		return err
+	}
+	log.Printf("%s certificate saved at %s", cert.Subject.CommonName, crtFile)
+	return nil
+}
+
+// marshalKey encode ECDSA keys in SEC 1 form, as the service always did,
+// and the others in PKCS#8.
+func marshalKey(key crypto.Signer) (*pem.Block, error) {
+	if ecKey, ok := key.(*ecdsa.PrivateKey); ok {
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+// CheckCA verify cert is a CA allowed to sign certificates with key.
+func CheckCA(cert *x509.Certificate, key crypto.Signer) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("not a CA certificate")
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("CA certificate without keyCertSign usage")
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+		return errors.New("private key does not match the certificate")
+	}
+	return nil
+}
+
+// LoadKeyPair read a PEM certificate and its unencrypted PEM private key,
+// in PKCS#8, SEC 1 or PKCS#1 form.
+func LoadKeyPair(certFile, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := ReadCertFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ReadKeyFile(keyFile, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// ReadCertFile read the first certificate of a PEM file.
+func ReadCertFile(file string) (*x509.Certificate, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// ReadKeyFile read a PEM private key. When it is encrypted the key is
+// decrypted with the result of passphrase, refused if passphrase is nil.
+func ReadKeyFile(file string, passphrase func() ([]byte, error)) (crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		key, err := ParsePrivateKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		return key, nil
+	}
+	if passphrase == nil {
+		return nil, fmt.Errorf("%s: encrypted private key", file)
+	}
+	p, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := DecryptPrivateKey(block, p)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey decode a PKCS#8, SEC 1 or PKCS#1 private key.
+func ParsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// some tools, PKCS#12 decoding among them, label SEC 1 and PKCS#1
+		// keys as PRIVATE KEY.
+		if ecKey, ecErr := x509.ParseECPrivateKey(block.Bytes); ecErr == nil {
+			return ecKey, nil
+		}
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes); rsaErr == nil {
+			return rsaKey, nil
+		}
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
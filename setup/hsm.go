@@ -0,0 +1,90 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ezbastion/ezb_pki/hsm"
+	"github.com/ezbastion/ezb_pki/models"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PINEnv is the environment variable holding the HSM PIN.
+const PINEnv = "EZB_PKI_HSM_PIN"
+
+// OpenHSM log in the PKCS#11 token of conf, with the PIN of the
+// configuration, PINEnv or typed on the terminal.
+func OpenHSM(conf models.Configuration) (hsm.Token, error) {
+	pin := conf.HSM.PIN
+	if pin == "" {
+		pin = os.Getenv(PINEnv)
+	}
+	if pin == "" {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, fmt.Errorf("the CA key is in a PKCS#11 token, set hsm.pin or %s", PINEnv)
+		}
+		p, err := readSecret("HSM PIN: ")
+		if err != nil {
+			return nil, err
+		}
+		pin = string(p)
+	}
+	return hsm.Open(hsm.Config{
+		Module:     conf.HSM.Module,
+		Slot:       conf.HSM.Slot,
+		TokenLabel: conf.HSM.TokenLabel,
+		PIN:        pin,
+	})
+}
+
+// HSMKeyLabel return the label of the CA key pair in the token,
+// <servicename>-ca unless set in the configuration.
+func HSMKeyLabel(conf models.Configuration) string {
+	if conf.HSM.Label != "" {
+		return conf.HSM.Label
+	}
+	return conf.ServiceName + "-ca"
+}
+
+// newSigningKey generate the key of the CA signing the nodes certificates,
+// in the PKCS#11 token when one is configured. The token is returned to be
+// closed once the CA certificate is signed, nil for a key in memory.
+func newSigningKey(conf models.Configuration, keyType string) (crypto.Signer, hsm.Token, error) {
+	if conf.HSM.Module == "" {
+		key, err := NewKey(keyType)
+		return key, nil, err
+	}
+	token, err := OpenHSM(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	label := HSMKeyLabel(conf)
+	if key, err := token.FindKey(label); err == nil {
+		token.Close()
+		return nil, nil, fmt.Errorf("the PKCS#11 token already holds a key pair labelled %q (%T)", label, key.Public())
+	}
+	key, err := token.GenerateKey(label, keyType)
+	if err != nil {
+		token.Close()
+		return nil, nil, err
+	}
+	log.Printf("Key pair %s generated in the PKCS#11 token.", label)
+	return key, token, nil
+}
@@ -0,0 +1,136 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build pkcs11
+// +build pkcs11
+
+package setup
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// softHSMModules are the usual paths of the SoftHSM v2 library,
+// SOFTHSM2_MODULE overrides them.
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	`C:\SoftHSM2\lib\softhsm2-x64.dll`,
+}
+
+// softHSMConfig initialize a new token in the SoftHSM of SOFTHSM2_CONF
+// and return a configuration using it and a function deleting it. The test
+// is skipped without SoftHSM.
+func softHSMConfig(t *testing.T) (models.Configuration, func()) {
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF is not set")
+	}
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, path := range softHSMModules {
+		if module != "" {
+			break
+		}
+		if _, err := os.Stat(path); err == nil {
+			module = path
+		}
+	}
+	if module == "" {
+		t.Skip("libsofthsm2 not found, set SOFTHSM2_MODULE")
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+	label := fmt.Sprintf("ezb-pki-test-%d", time.Now().UnixNano())
+	out, err := exec.Command(util, "--init-token", "--free", "--label", label, "--pin", "1234", "--so-pin", "1234").CombinedOutput()
+	if err != nil {
+		t.Fatalf("softhsm2-util --init-token: %v\n%s", err, out)
+	}
+	conf := models.Configuration{
+		ServiceName: "ezb_pki",
+		HSM:         models.HSM{Module: module, TokenLabel: label, PIN: "1234"},
+	}
+	return conf, func() {
+		exec.Command(util, "--delete-token", "--token", label).Run()
+	}
+}
+
+func TestNewSigningKeyHSM(t *testing.T) {
+	conf, cleanup := softHSMConfig(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "hsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serials := ca.NewSerialAllocator(filepath.Join(dir, "ca.srl"))
+
+	key, token, err := newSigningKey(conf, "p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == nil {
+		t.Fatal("key generated out of the token")
+	}
+	root, err := newCA(serials, key, "ezb_pki HSM test", nil, nil, time.Now().Add(time.Hour), -1)
+	token.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, token, err := newSigningKey(conf, "p256"); err == nil {
+		token.Close()
+		t.Fatal("second key pair generated with the same label")
+	}
+
+	// the service finds the key pair again to sign
+	token, err = OpenHSM(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.Close()
+	found, err := token.FindKey(HSMKeyLabel(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCA(root, found); err != nil {
+		t.Fatal(err)
+	}
+	subKey, err := NewKey("p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := newCA(serials, subKey, "ezb_pki HSM test signing", root, found, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := sub.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,415 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/hsm"
+	"github.com/ezbastion/ezb_pki/models"
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+)
+
+type basicConstraints struct {
+	IsCA       bool `asn1:"optional"`
+	MaxPathLen int  `asn1:"optional,default:-1"`
+}
+
+// createCSR create the CA key, in the PKCS#11 token when configured or as
+// <servicename>-ca-pending.key, and the request to have it signed by an
+// external CA, <servicename>-ca.csr.
+func createCSR(conf models.Configuration, opts Options) error {
+	pendingKey := certFile(conf, "ca-pending", "key")
+	if _, err := os.Stat(pendingKey); err == nil {
+		return fmt.Errorf("%s exists, import the signed certificate with init --import", pendingKey)
+	}
+	var passphrase []byte
+	var err error
+	if conf.HSM.Module == "" {
+		if passphrase, err = keyPassphrase(opts.Unencrypted); err != nil {
+			return err
+		}
+	}
+	key, token, err := newSigningKey(conf, opts.KeyType)
+	if err != nil {
+		return err
+	}
+	if token != nil {
+		defer token.Close()
+	} else {
+		block, err := encodeKey(key, passphrase)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(pendingKey, pem.EncodeToMemory(block), 0600); err != nil {
+			return err
+		}
+		log.Println("Private key saved at " + pendingKey)
+	}
+
+	constraints, err := asn1.Marshal(basicConstraints{IsCA: true, MaxPathLen: -1})
+	if err != nil {
+		return err
+	}
+	// digitalSignature, keyCertSign and cRLSign.
+	usage, err := asn1.Marshal(asn1.BitString{Bytes: []byte{0x86}, BitLength: 7})
+	if err != nil {
+		return err
+	}
+	sigAlg, _, _, err := ca.SignatureAlgorithm(key.Public())
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   conf.ServiceName,
+		},
+		SignatureAlgorithm: sigAlg,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionBasicConstraints, Critical: true, Value: constraints},
+			{Id: oidExtensionKeyUsage, Critical: true, Value: usage},
+		},
+	}, key)
+	if err != nil {
+		return err
+	}
+	csrFile := certFile(conf, "ca", "csr")
+	if err = ioutil.WriteFile(csrFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("\nCertificate request saved at %s.\n", csrFile)
+	fmt.Println("Have it signed by your CA with a subordinate CA template, then install the certificate with its chain:")
+	if opts.ExternalCA {
+		fmt.Println("    ezb_pki ca install-cert <signed certificate and chain>")
+	} else {
+		fmt.Println("    ezb_pki init --import <signed certificate and chain>")
+	}
+	return nil
+}
+
+// RequestPending tell if a CA certificate request waits for its
+// certificate, the service cannot sign until it is installed.
+func RequestPending(conf models.Configuration) bool {
+	_, err := os.Stat(certFile(conf, "ca", "csr"))
+	return err == nil
+}
+
+// InstallCert install the certificate issued by the parent CA for the
+// request of init --external-ca. file holds it and its chain, which must
+// build a path to a certificate of anchorFile, conf.TrustAnchor when empty.
+func InstallCert(conf models.Configuration, file string, anchorFile string) error {
+	if !RequestPending(conf) {
+		return errors.New("no CA certificate request is pending, create one with init --external-ca")
+	}
+	if anchorFile == "" {
+		anchorFile = conf.TrustAnchor
+	}
+	if anchorFile == "" {
+		return errors.New("no trust anchor configured, set trustanchor or use --trust-anchor")
+	}
+	anchors, err := readAnchors(anchorFile)
+	if err != nil {
+		return err
+	}
+	certs, k, err := readImport(file)
+	if err != nil {
+		return err
+	}
+	if k != nil {
+		return fmt.Errorf("%s holds a private key, the CA key is the one of the request", file)
+	}
+	key, token, err := requestKey(conf)
+	if err != nil {
+		return err
+	}
+	if token != nil {
+		defer token.Close()
+	}
+
+	caCert, _, err := importChain(certs, key)
+	if err != nil {
+		return err
+	}
+	if err = CheckCA(caCert, key); err != nil {
+		return fmt.Errorf("%s: %v", caCert.Subject, err)
+	}
+	if now := time.Now(); now.Before(caCert.NotBefore) || now.After(caCert.NotAfter) {
+		return fmt.Errorf("%s is valid from %s to %s", caCert.Subject, caCert.NotBefore, caCert.NotAfter)
+	}
+	roots := x509.NewCertPool()
+	for _, anchor := range anchors {
+		roots.AddCert(anchor)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs {
+		if cert != caCert {
+			intermediates.AddCert(cert)
+		}
+	}
+	chains, err := caCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("%s does not chain to the trust anchor %s: %v", caCert.Subject, anchorFile, err)
+	}
+	return installCA(conf, caCert, chains[0], key, true, false)
+}
+
+// readAnchors read the PEM certificates of a trust anchor file.
+func readAnchors(file string) ([]*x509.Certificate, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var anchors []*x509.Certificate
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		anchors = append(anchors, cert)
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("%s holds no certificate", file)
+	}
+	return anchors, nil
+}
+
+// importCA install the CA certificate of opts.Import issued by an external
+// CA. The key comes from the same file, opts.ImportKey, or the key created
+// by createCSR. The other certificates of the files make the chain.
+func importCA(conf models.Configuration, opts Options) error {
+	certs, key, err := readImport(opts.Import)
+	if err != nil {
+		return err
+	}
+	if opts.ImportKey != "" {
+		keyCerts, k, err := readImport(opts.ImportKey)
+		if err != nil {
+			return err
+		}
+		certs, key = append(certs, keyCerts...), k
+	}
+	pending := false
+	if key != nil && conf.HSM.Module != "" {
+		return errors.New("importing a key in a PKCS#11 token is not supported, create it with init --csr")
+	}
+	if key == nil {
+		var token hsm.Token
+		key, token, err = requestKey(conf)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s holds no private key, and no request is pending", opts.Import)
+		}
+		if err != nil {
+			return err
+		}
+		if token != nil {
+			defer token.Close()
+		}
+		pending = true
+	}
+
+	caCert, chain, err := importChain(certs, key)
+	if err != nil {
+		return err
+	}
+	if err = CheckCA(caCert, key); err != nil {
+		return fmt.Errorf("%s: %v", caCert.Subject, err)
+	}
+	if now := time.Now(); now.Before(caCert.NotBefore) || now.After(caCert.NotAfter) {
+		return fmt.Errorf("%s is valid from %s to %s", caCert.Subject, caCert.NotBefore, caCert.NotAfter)
+	}
+	root := chain[len(chain)-1]
+	if !bytes.Equal(root.RawIssuer, root.RawSubject) {
+		log.Printf("WARNING: the chain stops at %s, add the certificate of %s to the import to send the full chain to the nodes.", root.Subject, root.Issuer)
+	}
+
+	return installCA(conf, caCert, chain, key, pending, opts.Unencrypted)
+}
+
+// requestKey load the key created by createCSR, from the PKCS#11 token or
+// <servicename>-ca-pending.key. The token is returned to be closed.
+func requestKey(conf models.Configuration) (crypto.Signer, hsm.Token, error) {
+	if conf.HSM.Module == "" {
+		key, err := ReadKeyFile(certFile(conf, "ca-pending", "key"), func() ([]byte, error) {
+			return Passphrase(conf, "CA key passphrase: ")
+		})
+		return key, nil, err
+	}
+	if _, err := os.Stat(certFile(conf, "ca", "csr")); err != nil {
+		return nil, nil, err
+	}
+	token, err := OpenHSM(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := token.FindKey(HSMKeyLabel(conf))
+	if err != nil {
+		token.Close()
+		return nil, nil, err
+	}
+	return key, token, nil
+}
+
+// installCA save the signing CA certificate, its chain and key. A pending
+// key, created with the request, is moved in place and the request removed,
+// an imported key is encrypted unless unencrypted.
+func installCA(conf models.Configuration, caCert *x509.Certificate, chain []*x509.Certificate, key crypto.Signer, pending bool, unencrypted bool) error {
+	err := saveCert(conf, "ca", caCert)
+	if err != nil {
+		return err
+	}
+	if len(chain) > 1 {
+		if err = saveChain(conf, chain); err != nil {
+			return err
+		}
+	}
+	keyFile := certFile(conf, "ca", "key")
+	switch {
+	case pending && conf.HSM.Module == "":
+		if err = os.Rename(certFile(conf, "ca-pending", "key"), keyFile); err != nil {
+			return err
+		}
+	case pending:
+	default:
+		passphrase, err := keyPassphrase(unencrypted)
+		if err != nil {
+			return err
+		}
+		block, err := encodeKey(key, passphrase)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+			return err
+		}
+		log.Println("Private key saved at " + keyFile)
+	}
+	if pending {
+		os.Remove(certFile(conf, "ca", "csr"))
+	}
+	root := chain[len(chain)-1]
+	fmt.Printf("\n%s installed, issued by %s. Root SHA-256 fingerprint %X.\n", caCert.Subject, caCert.Issuer, sha256.Sum256(root.Raw))
+	return nil
+}
+
+// importChain find the certificate of key among certs, and the chain from
+// it up to the root with the others.
+func importChain(certs []*x509.Certificate, key crypto.Signer) (*x509.Certificate, []*x509.Certificate, error) {
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	var caCert *x509.Certificate
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawSubjectPublicKeyInfo, pub) {
+			caCert = cert
+			break
+		}
+	}
+	if caCert == nil {
+		return nil, nil, errors.New("no imported certificate matches the private key")
+	}
+	chain := []*x509.Certificate{caCert}
+	for cert := caCert; !bytes.Equal(cert.RawIssuer, cert.RawSubject); {
+		var issuer *x509.Certificate
+		for _, c := range certs {
+			if c != cert && cert.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil || len(chain) > len(certs) {
+			break
+		}
+		chain = append(chain, issuer)
+		cert = issuer
+	}
+	return caCert, chain, nil
+}
+
+// readImport read the certificates and the private key, if any, of a PEM
+// or PKCS#12 file. Encrypted keys and PKCS#12 files ask for their password.
+func readImport(file string) ([]*x509.Certificate, crypto.Signer, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	var blocks []*pem.Block
+	if bytes.Contains(raw, []byte("-----BEGIN ")) {
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			blocks = append(blocks, block)
+		}
+	} else {
+		password, err := readSecret(fmt.Sprintf("%s password: ", file))
+		if err != nil {
+			return nil, nil, err
+		}
+		if blocks, err = pkcs12.ToPEM(raw, string(password)); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	var certs []*x509.Certificate
+	var key crypto.Signer
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", file, err)
+			}
+			certs = append(certs, cert)
+		case "ENCRYPTED PRIVATE KEY":
+			password, err := readSecret(fmt.Sprintf("%s key passphrase: ", file))
+			if err != nil {
+				return nil, nil, err
+			}
+			if key, err = DecryptPrivateKey(block, password); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", file, err)
+			}
+		case "PRIVATE KEY", "EC PRIVATE KEY", "RSA PRIVATE KEY":
+			if key, err = ParsePrivateKey(block); err != nil {
+				return nil, nil, fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+	return certs, key, nil
+}
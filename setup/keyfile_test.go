@@ -0,0 +1,187 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func samePublicKey(t *testing.T, a, b crypto.Signer) bool {
+	derA, err := x509.MarshalPKIXPublicKey(a.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	derB, err := x509.MarshalPKIXPublicKey(b.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Equal(derA, derB)
+}
+
+func TestEncodeKeyRoundTrip(t *testing.T) {
+	passphrase := []byte("correct horse")
+	for _, keyType := range []string{"p256", "rsa2048", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			key, err := NewKey(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block, err := encodeKey(key, passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Type != "ENCRYPTED PRIVATE KEY" {
+				t.Fatalf("block type %s, want ENCRYPTED PRIVATE KEY", block.Type)
+			}
+			decoded, err := DecryptPrivateKey(block, passphrase)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !samePublicKey(t, key, decoded) {
+				t.Fatal("decrypted key does not match")
+			}
+		})
+	}
+}
+
+func TestEncodeKeyParameters(t *testing.T) {
+	key, err := NewKey("p256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := encodeKey(key, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf scryptParams
+	if _, err = asn1.Unmarshal(block.Bytes, &info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		t.Fatal(err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidScrypt) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		t.Fatalf("encrypted with %v and %v, want scrypt and AES-256-CBC", params.KeyDerivationFunc.Algorithm, params.EncryptionScheme.Algorithm)
+	}
+	if kdf.CostParameter < 1<<17 || kdf.BlockSize != 8 || len(kdf.Salt) < 16 {
+		t.Fatalf("scrypt N=%d r=%d salt of %d bytes", kdf.CostParameter, kdf.BlockSize, len(kdf.Salt))
+	}
+
+	if _, err = DecryptPrivateKey(block, []byte("wrong")); err != ErrPassphrase {
+		t.Fatalf("wrong passphrase: got %v, want %v", err, ErrPassphrase)
+	}
+
+	unencrypted, err := encodeKey(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ParsePrivateKey(unencrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !samePublicKey(t, key, decoded) {
+		t.Fatal("unencrypted key does not match")
+	}
+}
+
+// TestOpenSSLPKCS8 decrypt the keys encrypted by openssl pkcs8 and have
+// openssl decrypt ours, with the scrypt cost openssl accepts.
+func TestOpenSSLPKCS8(t *testing.T) {
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl not found")
+	}
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	openssl := func(args ...string) []byte {
+		out, err := exec.Command("openssl", args...).Output()
+		if err != nil {
+			t.Fatalf("openssl %v: %v", args, err)
+		}
+		return out
+	}
+	plainFile := filepath.Join(dir, "key.pem")
+	openssl("genpkey", "-algorithm", "EC", "-pkeyopt", "ec_paramgen_curve:P-256", "-out", plainFile)
+	raw, err := ioutil.ReadFile(plainFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(raw)
+	key, err := ParsePrivateKey(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, args := range map[string][]string{
+		"scrypt": {"-scrypt"},
+		"pbkdf2": {"-v2", "aes-256-cbc", "-v2prf", "hmacWithSHA256"},
+		"aes128": {"-v2", "aes-128-cbc"},
+	} {
+		t.Run("from "+name, func(t *testing.T) {
+			out := openssl(append([]string{"pkcs8", "-topk8", "-in", plainFile, "-passout", "pass:secret"}, args...)...)
+			block, _ := pem.Decode(out)
+			if block == nil {
+				t.Fatalf("no PEM in openssl output")
+			}
+			decoded, err := DecryptPrivateKey(block, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !samePublicKey(t, key, decoded) {
+				t.Fatal("decrypted key does not match")
+			}
+		})
+	}
+
+	t.Run("to openssl", func(t *testing.T) {
+		block, err := encryptPrivateKey(key, []byte("secret"), 1<<14)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encFile := filepath.Join(dir, "enc.pem")
+		if err = ioutil.WriteFile(encFile, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		out := openssl("pkcs8", "-in", encFile, "-passin", "pass:secret")
+		plain, _ := pem.Decode(out)
+		if plain == nil {
+			t.Fatalf("no PEM in openssl output")
+		}
+		decoded, err := ParsePrivateKey(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !samePublicKey(t, key, decoded) {
+			t.Fatal("key decrypted by openssl does not match")
+		}
+	})
+}
@@ -0,0 +1,204 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// PassphraseEnv is the environment variable holding the CA key passphrase.
+const PassphraseEnv = "EZB_PKI_PASSPHRASE"
+
+// Passphrase return the passphrase of the encrypted CA key, read from
+// PassphraseEnv, the keypassphrase file or agent of conf, or prompted on
+// the terminal.
+func Passphrase(conf models.Configuration, prompt string) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	if file := conf.KeyPassphrase.File; file != "" {
+		if !filepath.IsAbs(file) {
+			file = path.Join(exPath, file)
+		}
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		line, _, _ := bufio.NewReader(bytes.NewReader(raw)).ReadLine()
+		return line, nil
+	}
+	if conf.KeyPassphrase.Agent != "" {
+		return agentPassphrase(conf.KeyPassphrase.Agent, conf.ServiceName)
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("the CA key is encrypted, set %s, keypassphrase.file or keypassphrase.agent", PassphraseEnv)
+	}
+	return readSecret(prompt)
+}
+
+// readSecret prompt for a secret on the terminal without echoing it.
+func readSecret(prompt string) ([]byte, error) {
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("no terminal to type the secret in")
+	}
+	fmt.Print(prompt)
+	p, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return p, err
+}
+
+// agentPassphrase ask the key agent listening on the unix socket addr:
+// it receives the service name on a line and answers the passphrase on
+// a line.
+func agentPassphrase(addr string, service string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", addr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("key agent: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = fmt.Fprintln(conn, service); err != nil {
+		return nil, fmt.Errorf("key agent: %v", err)
+	}
+	line, _, err := bufio.NewReader(conn).ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("key agent: %v", err)
+	}
+	if len(line) == 0 {
+		return nil, errors.New("key agent: no passphrase for " + service)
+	}
+	return line, nil
+}
+
+// newPassphrase return the passphrase protecting new keys, from
+// PassphraseEnv or typed twice on the terminal, empty when none was
+// given.
+func newPassphrase(prompt string) ([]byte, error) {
+	if p := os.Getenv(PassphraseEnv); p != "" {
+		return []byte(p), nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, nil
+	}
+	for {
+		fmt.Print(prompt)
+		p, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil || len(p) == 0 {
+			return nil, err
+		}
+		fmt.Print("Confirm passphrase: ")
+		confirm, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(p, confirm) {
+			return p, nil
+		}
+		fmt.Println("Passphrases do not match.")
+	}
+}
+
+// errNoPassphrase is returned when a key is to be encrypted and no
+// passphrase was given.
+var errNoPassphrase = fmt.Errorf("no passphrase given, type one or set %s, --unencrypted stores the key in clear", PassphraseEnv)
+
+// keyPassphrase ask the passphrase of the CA keys created by Setup, none
+// when unencrypted.
+func keyPassphrase(unencrypted bool) ([]byte, error) {
+	if unencrypted {
+		log.Println("WARNING: the CA key is stored unencrypted, encrypt it later with rekey-passphrase.")
+		return nil, nil
+	}
+	passphrase, err := newPassphrase("CA key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errNoPassphrase
+	}
+	return passphrase, nil
+}
+
+// RekeyPassphrase encrypt cert/<servicename>-<name>.key with a new
+// passphrase, or store it in clear when unencrypted.
+func RekeyPassphrase(conf models.Configuration, name string, unencrypted bool) error {
+	keyFile := certFile(conf, name, "key")
+	key, err := ReadKeyFile(keyFile, func() ([]byte, error) {
+		return Passphrase(conf, "Current passphrase: ")
+	})
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	// the new passphrase is never taken from the environment, which may
+	// hold the current one.
+	os.Unsetenv(PassphraseEnv)
+	var passphrase []byte
+	if !unencrypted {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return cli.NewExitError("rekey-passphrase needs a terminal", -1)
+		}
+		if passphrase, err = newPassphrase("New passphrase: "); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		if len(passphrase) == 0 {
+			return cli.NewExitError(errNoPassphrase, -1)
+		}
+	}
+	block, err := encodeKey(key, passphrase)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	tmp := keyFile + ".new"
+	if err = ioutil.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = os.Rename(tmp, keyFile); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if len(passphrase) == 0 {
+		log.Println("WARNING: " + keyFile + " is stored unencrypted.")
+	} else {
+		log.Println(keyFile + " encrypted with the new passphrase.")
+	}
+	return nil
+}
+
+// encodeKey encrypt key with passphrase, or encode it in clear when
+// passphrase is empty.
+func encodeKey(key crypto.Signer, passphrase []byte) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		return marshalKey(key)
+	}
+	return EncryptPrivateKey(key, passphrase)
+}
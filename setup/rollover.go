@@ -0,0 +1,218 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package setup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/urfave/cli"
+)
+
+// Rollover is the transition from the previous root to the current one,
+// started by StartRollover. Until its end the service sends the chain up
+// to the previous root and serves both roots in the trust bundle.
+type Rollover struct {
+	Until time.Time `json:"until"`
+	// Previous is the replaced root.
+	Previous *x509.Certificate `json:"-"`
+	// CrossNew certify the current key with the previous root, CrossPrevious
+	// the previous key with the current root.
+	CrossNew      *x509.Certificate `json:"-"`
+	CrossPrevious *x509.Certificate `json:"-"`
+}
+
+// Active tell if the transition window is not over.
+func (r *Rollover) Active() bool {
+	return r != nil && time.Now().Before(r.Until)
+}
+
+// LoadRollover read the last rollover, nil when the CA was never rolled
+// over.
+func LoadRollover(conf models.Configuration) (*Rollover, error) {
+	raw, err := ioutil.ReadFile(certFile(conf, "rollover", "json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &Rollover{}
+	if err = json.Unmarshal(raw, r); err != nil {
+		return nil, err
+	}
+	if r.Previous, err = ReadCertFile(certFile(conf, "previous", "crt")); err != nil {
+		return nil, err
+	}
+	if r.CrossNew, err = ReadCertFile(certFile(conf, "cross-new", "crt")); err != nil {
+		return nil, err
+	}
+	if r.CrossPrevious, err = ReadCertFile(certFile(conf, "cross-previous", "crt")); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// StartRollover replace the self-signed CA by a new root with a keyType
+// key, the same algorithm when empty. The previous root and key are kept
+// as <servicename>-previous.crt/key, the cross-certificates as
+// <servicename>-cross-new.crt and <servicename>-cross-previous.crt.
+func StartRollover(conf models.Configuration, keyType string, transition time.Duration) error {
+	if conf.HSM.Module != "" {
+		return cli.NewExitError("the CA key is in a PKCS#11 token, roll it over with the token tools", -1)
+	}
+	if r, err := LoadRollover(conf); err != nil {
+		return cli.NewExitError(err, -1)
+	} else if r.Active() {
+		return cli.NewExitError(fmt.Sprintf("a rollover is in transition until %s", r.Until.Format(time.RFC3339)), -1)
+	}
+	crtFile, keyFile := certFile(conf, "ca", "crt"), certFile(conf, "ca", "key")
+	old, err := ReadCertFile(crtFile)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if !bytes.Equal(old.RawIssuer, old.RawSubject) || old.CheckSignatureFrom(old) != nil {
+		return cli.NewExitError("the signing CA is an intermediate, issue a new one with the offline root instead", -1)
+	}
+	var passphrase []byte
+	oldKey, err := ReadKeyFile(keyFile, func() ([]byte, error) {
+		p, err := Passphrase(conf, "CA key passphrase: ")
+		passphrase = p
+		return p, err
+	})
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = CheckCA(old, oldKey); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if keyType == "" {
+		keyType = keyTypeOf(oldKey.Public())
+	}
+	key, err := NewKey(keyType)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+
+	serials := ca.NewSerialAllocator(certFile(conf, "ca", "srl"))
+	cn := fmt.Sprintf("%s %s", conf.ServiceName, time.Now().Format("2006-01-02"))
+	root, err := newCA(serials, key, cn, nil, nil, time.Now().AddDate(20, 0, 0), -1)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	notAfter := root.NotAfter
+	if old.NotAfter.Before(notAfter) {
+		notAfter = old.NotAfter
+	}
+	crossNew, err := crossCertify(serials, root, old, oldKey, notAfter)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	crossPrevious, err := crossCertify(serials, old, root, key, old.NotAfter)
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+
+	// keep the previous root first, a failure below leaves it in place.
+	if err = copyFile(crtFile, certFile(conf, "previous", "crt"), 0644); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = copyFile(keyFile, certFile(conf, "previous", "key"), 0600); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = saveCert(conf, "cross-new", crossNew); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = saveCert(conf, "cross-previous", crossPrevious); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	state, _ := json.Marshal(&Rollover{Until: time.Now().Add(transition)})
+	if err = ioutil.WriteFile(certFile(conf, "rollover", "json"), state, 0644); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	if err = saveKeyPair(conf, "ca", root, key, passphrase); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	fmt.Printf("\nNew root %s, SHA-256 fingerprint %X.\n", cn, sha256.Sum256(root.Raw))
+	fmt.Printf("Restart the service. Until %s it sends the chain up to the previous root and serves both roots at <publicurl>/bundle.crt.\n",
+		time.Now().Add(transition).Format(time.RFC3339))
+	fmt.Printf("Add the new root to the nodes trust during the transition, then restart the service once it is over.\n")
+	fmt.Printf("The service signs the CRL and OCSP responses of the previous root with %s, move it to offline storage once its certificates expired.\n", certFile(conf, "previous", "key"))
+	return nil
+}
+
+// crossCertify issue a CA certificate for the subject and key of subject,
+// signed by issuer.
+func crossCertify(serials *ca.SerialAllocator, subject, issuer *x509.Certificate, issuerKey crypto.Signer, notAfter time.Time) (*x509.Certificate, error) {
+	sigAlg, _, _, err := ca.SignatureAlgorithm(issuerKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serials.Next()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		RawSubject:            subject.RawSubject,
+		SubjectKeyId:          subject.SubjectKeyId,
+		NotBefore:             time.Now(),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		SignatureAlgorithm:    sigAlg,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, subject.PublicKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// keyTypeOf return the KeyTypes name of pub.
+func keyTypeOf(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		return map[int]string{256: "p256", 384: "p384", 521: "p521"}[pub.Curve.Params().BitSize]
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", pub.N.BitLen())
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return ""
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	raw, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, raw, perm)
+}
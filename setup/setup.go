@@ -16,8 +16,6 @@
 package setup
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -26,13 +24,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/ezbastion/ezb_lib/setupmanager"
+	"github.com/ezbastion/ezb_pki/ca"
 	"github.com/ezbastion/ezb_pki/models"
 
 	"github.com/ShowMax/go-fqdn"
@@ -63,7 +62,12 @@ func CheckConfig() (conf models.Configuration, err error) {
 	return conf, nil
 }
 
-func Setup() error {
+// Setup ask for the configuration on first run and create the CA
+// described by opts when its key does not exist.
+func Setup(opts Options) error {
+	if !validKeyType(opts.KeyType) {
+		return cli.NewExitError(fmt.Sprintf("unknown key type %q, use one of %s", opts.KeyType, strings.Join(KeyTypes, ", ")), -1)
+	}
 	fqdn := fqdn.Get()
 	hostname, _ := os.Hostname()
 	quiet := true
@@ -75,12 +79,39 @@ func Setup() error {
 	if err != nil {
 		quiet = false
 		conf.Listen = "0.0.0.0:5010"
+		conf.HTTPListen = "0.0.0.0:5011"
+		conf.PublicURL = "http://" + fqdn + ":5011"
 		conf.ServiceName = "ezb_pki"
 		conf.ServiceFullName = "ezBastion PKI"
 		conf.Logger.LogLevel = "warning"
 		conf.Logger.MaxSize = 5
 		conf.Logger.MaxBackups = 10
 		conf.Logger.MaxAge = 180
+		conf.CRL.Interval = 60
+		conf.CRL.Validity = 24
+		conf.DefaultProfile = models.DefaultProfileName
+		conf.Profiles = map[string]models.Profile{
+			models.DefaultProfileName: models.DefaultProfile,
+			"worker": {
+				Validity:    "365d",
+				KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+				ExtKeyUsage: []string{"clientAuth", "serverAuth"},
+			},
+			"proxy": {
+				Validity:    "365d",
+				KeyUsage:    []string{"digitalSignature", "keyEncipherment"},
+				ExtKeyUsage: []string{"clientAuth", "serverAuth"},
+			},
+			"jwt-signer": {
+				Validity: "365d",
+				KeyUsage: []string{"digitalSignature"},
+			},
+			"admin": {
+				Validity:    "90d",
+				KeyUsage:    []string{"digitalSignature"},
+				ExtKeyUsage: []string{"clientAuth"},
+			},
+		}
 	}
 	if quiet == false {
 		fmt.Println("\nWhich port do you want to listen to?")
@@ -94,6 +125,28 @@ func Setup() error {
 			}
 		}
 
+		fmt.Println("\nWhich port do you want to publish the CRL on (http)?")
+		fmt.Println("ex: :5011, 0.0.0.0:5101, localhost:7801, name.domain:2001 ...")
+		for {
+			listen := setupmanager.AskForValue("http listen", conf.HTTPListen, "^[\\.0-9|\\w]*:[0-9]{1,5}$")
+			c := setupmanager.AskForConfirmation(fmt.Sprintf("Listen on (%s) ok?", listen))
+			if c {
+				conf.HTTPListen = listen
+				break
+			}
+		}
+
+		fmt.Println("\nWhat is the public url of the http port, as seen by ezBastion nodes?")
+		fmt.Println("ex: http://pki.domain:5011 ...")
+		for {
+			url := setupmanager.AskForValue("public url", conf.PublicURL, "^https?://[\\.0-9\\w-]+(:[0-9]{1,5})?$")
+			c := setupmanager.AskForConfirmation(fmt.Sprintf("Public url (%s) ok?", url))
+			if c {
+				conf.PublicURL = url
+				break
+			}
+		}
+
 		fmt.Println("\nWhat is service name?")
 		fmt.Println("ex: ezb_pki, myPKI-p5010, api-pki-uat ...")
 		for {
@@ -123,23 +176,82 @@ func Setup() error {
 	}
 
 	keyfile := path.Join(exPath, "cert/"+conf.ServiceName+"-ca.key")
-	if _, err := os.Stat(keyfile); os.IsNotExist(err) {
-		keyOut, _ := os.OpenFile(keyfile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-
-		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	hierarchy := opts.Intermediates > 0 || opts.RootCert != ""
+	if conf.HSM.Module != "" {
+		// the key is in the token, the certificate tells if the CA exists.
+		if _, err := os.Stat(certFile(conf, "ca", "crt")); !os.IsNotExist(err) {
+			return nil
+		}
+	} else if _, err := os.Stat(keyfile); !os.IsNotExist(err) {
+		return nil
+	}
+	switch {
+	case opts.ExternalCA:
+		if opts.TrustAnchor != "" {
+			if conf.TrustAnchor, err = filepath.Abs(opts.TrustAnchor); err != nil {
+				return cli.NewExitError(err, -1)
+			}
+		}
+		if conf.TrustAnchor == "" {
+			return cli.NewExitError("--external-ca needs the --trust-anchor the CA certificate must chain to", -1)
+		}
+		if _, err := readAnchors(conf.TrustAnchor); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		c, _ := json.Marshal(conf)
+		if err := ioutil.WriteFile(confFile, c, 0600); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		fallthrough
+	case opts.CSR:
+		if err := createCSR(conf, opts); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		return nil
+	case opts.Import != "":
+		if err := importCA(conf, opts); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		return nil
+	}
+	var passphrase []byte
+	if conf.HSM.Module == "" || (hierarchy && (opts.RootCert == "" || opts.Intermediates > 1)) {
+		if passphrase, err = keyPassphrase(opts.Unencrypted); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+	}
+	if hierarchy {
+		if err := createHierarchy(conf, opts, passphrase); err != nil {
+			return cli.NewExitError(err, -1)
+		}
+	} else {
+		priv, token, err := newSigningKey(conf, opts.KeyType)
 		if err != nil {
-			panic(err)
+			return cli.NewExitError(err, -1)
 		}
-		b, err := x509.MarshalECPrivateKey(priv)
+		sigAlg, _, _, err := ca.SignatureAlgorithm(priv.Public())
 		if err != nil {
-			panic(err)
+			return cli.NewExitError(err, -1)
+		}
+		if token != nil {
+			defer token.Close()
+		} else {
+			block, err := encodeKey(priv, passphrase)
+			if err != nil {
+				return cli.NewExitError(err, -1)
+			}
+			if err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(block), 0600); err != nil {
+				return cli.NewExitError(err, -1)
+			}
+			log.Println("Private key saved at " + keyfile)
 		}
-		pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-		keyOut.Close()
-		log.Println("Private key saved at " + keyfile)
 
-		ca := &x509.Certificate{
-			SerialNumber: big.NewInt(1653),
+		serial, err := ca.NewSerialAllocator(path.Join(exPath, "cert/"+conf.ServiceName+"-ca.srl")).Next()
+		if err != nil {
+			return cli.NewExitError(err, -1)
+		}
+		root := &x509.Certificate{
+			SerialNumber: serial,
 			Subject: pkix.Name{
 				Organization: []string{"ezBastion"},
 				CommonName:   conf.ServiceName,
@@ -149,12 +261,11 @@ func Setup() error {
 			NotAfter:              time.Now().AddDate(20, 0, 0),
 			IsCA:                  true,
 			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageKeyEncipherment,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageKeyEncipherment,
 			BasicConstraintsValid: true,
-			SignatureAlgorithm:    x509.ECDSAWithSHA256,
+			SignatureAlgorithm:    sigAlg,
 		}
-		pub := &priv.PublicKey
-		caB, err := x509.CreateCertificate(rand.Reader, ca, ca, pub, priv)
+		caB, err := x509.CreateCertificate(rand.Reader, root, root, priv.Public(), priv)
 		if err != nil {
 			return cli.NewExitError(err, -1)
 		}
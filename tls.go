@@ -0,0 +1,150 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ShowMax/go-fqdn"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+)
+
+// tlsServerTemplate is the certificate of the signing port, the EST, ACME,
+// API and gRPC servers, valid for the host names and the listen addresses.
+func tlsServerTemplate() *x509.Certificate {
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   fqdn.Get(),
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		DNSNames:              []string{fqdn.Get()},
+		BasicConstraintsValid: true,
+	}
+	if hostname, err := os.Hostname(); err == nil && !strings.EqualFold(hostname, fqdn.Get()) {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	for _, listen := range []string{conf.Listen, conf.EST.Listen, conf.ACME.Listen, conf.API.Listen, conf.GRPC.Listen} {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil || host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip == nil {
+			if !containsFold(template.DNSNames, host) {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		} else if !ip.IsUnspecified() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		}
+	}
+	addRevocationInfo(template)
+	return template
+}
+
+// tlsConfig serve the signing port with the daemon server certificate and
+// verify the client certificates issued by the CA, when given.
+func (rca *rootCA) tlsConfig() *tls.Config {
+	roots := x509.NewCertPool()
+	roots.AddCert(rca.cert)
+	if rca.rollover.Active() {
+		roots.AddCert(rca.rollover.Previous)
+	}
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, key := rca.tlsCert.get()
+			return &tls.Certificate{
+				Certificate: append([][]byte{cert.Raw}, rca.chain...),
+				PrivateKey:  key,
+				Leaf:        cert,
+			}, nil
+		},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  roots,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// peerCertificate return the verified client certificate of a TLS
+// connection, nil for plain connections or clients without certificate.
+func peerCertificate(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	return state.PeerCertificates[0], nil
+}
+
+// authorizeRenewal accept csr from a client authenticated by a valid
+// certificate of ours, for the same names. The inventory record of the
+// current certificate is returned to issue the new one alike.
+func authorizeRenewal(store *db.Store, csr *x509.CertificateRequest, peer *x509.Certificate) (*models.Certificate, error) {
+	rec, err := store.Certificate(db.SerialKey(peer.SerialNumber))
+	if err == db.ErrNotFound {
+		return nil, errors.New("client certificate not in inventory")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status := rec.CurrentStatus(time.Now()); status != models.StatusValid {
+		return nil, fmt.Errorf("client certificate %s is %s", rec.Serial, status)
+	}
+	if csr.Subject.CommonName != peer.Subject.CommonName {
+		return nil, fmt.Errorf("renewal of %s cannot request %s", peer.Subject.CommonName, csr.Subject.CommonName)
+	}
+	for _, name := range csr.DNSNames {
+		if !containsFold(peer.DNSNames, name) {
+			return nil, fmt.Errorf("renewal of %s cannot add DNS name %s", peer.Subject.CommonName, name)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		found := false
+		for _, peerIP := range peer.IPAddresses {
+			found = found || peerIP.Equal(ip)
+		}
+		if !found {
+			return nil, fmt.Errorf("renewal of %s cannot add IP address %s", peer.Subject.CommonName, ip)
+		}
+	}
+	return rec, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezbastion/ezb_pki/ca"
+	"github.com/ezbastion/ezb_pki/db"
+	"github.com/ezbastion/ezb_pki/models"
+	"github.com/urfave/cli"
+)
+
+func createToken(c *cli.Context) error {
+	cn := c.String("cn")
+	if cn == "" {
+		return cli.NewExitError("--cn is required", -1)
+	}
+	ttl := c.Duration("ttl")
+	if ttl <= 0 {
+		return cli.NewExitError("--ttl must be positive", -1)
+	}
+	profile := c.String("profile")
+	if _, ok := conf.Profiles[profile]; profile != "" && !ok && len(conf.Profiles) > 0 {
+		return cli.NewExitError(fmt.Sprintf("unknown profile %s", profile), -1)
+	}
+	var ips []string
+	for _, s := range c.StringSlice("ip") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return cli.NewExitError(fmt.Sprintf("invalid IP address %q", s), -1)
+		}
+		ips = append(ips, ip.String())
+	}
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	hash := db.TokenHash(secret)
+	now := time.Now()
+	token := &models.Token{
+		ID:          hash[:8],
+		Hash:        hash,
+		CommonName:  cn,
+		DNSNames:    c.StringSlice("dns"),
+		IPAddresses: ips,
+		Profile:     profile,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if err := store.AddToken(token); err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	fmt.Printf("Token %s for %s, valid until %s:\n\n%s\n\n", token.ID, cn, token.ExpiresAt.Format(time.RFC3339), secret)
+	fmt.Println("Add it to the certificate request as PKCS#9 challengePassword attribute, it can be used once.")
+	return nil
+}
+
+func listTokens(c *cli.Context) error {
+	store, err := openStore()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	defer store.Close()
+	list, err := store.Tokens()
+	if err != nil {
+		return cli.NewExitError(err, -1)
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCOMMON NAME\tDNS NAMES\tIP ADDRESSES\tPROFILE\tEXPIRES\tSTATUS")
+	for _, token := range list {
+		status := "unused"
+		switch {
+		case !token.UsedAt.IsZero():
+			status = "used by " + token.UsedBy
+		case now.After(token.ExpiresAt):
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.CommonName, strings.Join(token.DNSNames, ","), strings.Join(token.IPAddresses, ","), token.Profile, token.ExpiresAt.Format(time.RFC3339), status)
+	}
+	return w.Flush()
+}
+
+// errTokenRequired is returned when a request carry no enrollment token.
+var errTokenRequired = errors.New("enrollment token required")
+
+// authorizeCSR redeem the enrollment token secret, or else the one sent as
+// challengePassword in csr, unless auto-enrollment is enabled. The redeemed
+// token is returned, nil with auto-enrollment, and must be released with
+// Store.ReleaseToken if the certificate is not issued.
+func authorizeCSR(store *db.Store, csr *x509.CertificateRequest, secret string, requester string) (*models.Token, error) {
+	if conf.AutoEnrollment {
+		return nil, nil
+	}
+	if secret == "" {
+		var err error
+		if secret, err = ca.ChallengePassword(csr); err != nil {
+			return nil, err
+		}
+	}
+	if secret == "" {
+		return nil, errTokenRequired
+	}
+	token, err := store.UseToken(secret, requester, func(token *models.Token) error {
+		if !strings.EqualFold(csr.Subject.CommonName, token.CommonName) {
+			return fmt.Errorf("token %s is bound to %s, not %s", token.ID, token.CommonName, csr.Subject.CommonName)
+		}
+		for _, name := range csr.DNSNames {
+			if !tokenAllows(token, name) {
+				return fmt.Errorf("token %s does not allow DNS name %s", token.ID, name)
+			}
+		}
+		for _, ip := range csr.IPAddresses {
+			found := false
+			for _, s := range token.IPAddresses {
+				found = found || net.ParseIP(s).Equal(ip)
+			}
+			if !found {
+				return fmt.Errorf("token %s does not allow IP address %s", token.ID, ip)
+			}
+		}
+		if len(csr.URIs) > 0 || len(csr.EmailAddresses) > 0 {
+			return fmt.Errorf("token %s does not allow URI nor email names", token.ID)
+		}
+		return nil
+	})
+	if err == db.ErrNotFound {
+		return nil, errors.New("invalid enrollment token")
+	}
+	return token, err
+}
+
+func tokenAllows(token *models.Token, name string) bool {
+	return strings.EqualFold(name, token.CommonName) || containsFold(token.DNSNames, name)
+}